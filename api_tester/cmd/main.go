@@ -2,12 +2,24 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/belalakhter/packages/api_tester/internal/core"
+	"github.com/belalakhter/packages/api_tester/internal/dashboard"
+	"github.com/belalakhter/packages/api_tester/internal/delivery"
 	"github.com/belalakhter/packages/api_tester/internal/flv"
 	"github.com/belalakhter/packages/api_tester/internal/hls"
+	"github.com/belalakhter/packages/api_tester/internal/metrics"
+	"github.com/belalakhter/packages/api_tester/internal/report"
 	"github.com/belalakhter/packages/api_tester/internal/sse"
 	"github.com/belalakhter/packages/api_tester/internal/ws"
 	"github.com/belalakhter/packages/api_tester/utils"
@@ -15,13 +27,32 @@ import (
 )
 
 type Config struct {
-	Addr         string `yaml:"addr"`
-	InitialCount int64  `yaml:"initial_count"`
-	Duration     int64  `yaml:"duration"`
-	PumpCount    int64  `yaml:"pump_count"`
-	Type         string `yaml:"type"`
+	Name           string             `yaml:"name"`
+	Addr           string             `yaml:"addr"`
+	InitialCount   int64              `yaml:"initial_count"`
+	Duration       int64              `yaml:"duration"`
+	PumpCount      int64              `yaml:"pump_count"`
+	Type           string             `yaml:"type"`
+	Profile        core.ProfileConfig `yaml:"profile"`
+	MaxDuration    core.Duration      `yaml:"max_duration"`
+	GracePeriod    core.Duration      `yaml:"grace_period"`
+	Progress       string             `yaml:"progress"`
+	SampleInterval core.Duration      `yaml:"sample_interval"`
+	Reports        []report.Config    `yaml:"reports"`
+	Thresholds     []string           `yaml:"thresholds"`
+	MetricsAddr    string             `yaml:"metrics_addr"`
+	OTLP           metrics.OTLPConfig `yaml:"otlp"`
+	WS             ws.Config          `yaml:"ws"`
+	SSE            sse.Config         `yaml:"sse"`
+	HLS            hls.Config         `yaml:"hls"`
 }
 
+const (
+	defaultGracePeriod  = time.Second * 5
+	thresholdExitCode   = 99
+	interruptedExitCode = 98
+)
+
 func loadConfig(configPath string) (*Config, error) {
 	absPath, err := filepath.Abs(configPath)
 	if err != nil {
@@ -49,14 +80,27 @@ func loadConfig(configPath string) (*Config, error) {
 	if config.Type == "" {
 		return nil, fmt.Errorf("type is required in config")
 	}
-	if config.InitialCount <= 0 {
-		return nil, fmt.Errorf("initial_count must be greater than 0")
-	}
 	if config.Duration <= 0 {
 		return nil, fmt.Errorf("duration must be greater than 0")
 	}
-	if config.PumpCount <= 0 {
-		return nil, fmt.Errorf("pump_count must be greater than 0")
+	if config.MaxDuration < 0 {
+		return nil, fmt.Errorf("max_duration must not be negative")
+	}
+	if config.SampleInterval < 0 {
+		return nil, fmt.Errorf("sample_interval must not be negative")
+	}
+	if config.Name == "" {
+		config.Name = strings.TrimSuffix(filepath.Base(absPath), filepath.Ext(absPath))
+	}
+	if config.GracePeriod <= 0 {
+		config.GracePeriod = core.Duration(defaultGracePeriod)
+	}
+	for i, r := range config.Reports {
+		resolved, err := r.Resolve()
+		if err != nil {
+			return nil, err
+		}
+		config.Reports[i] = resolved
 	}
 
 	return &config, nil
@@ -76,18 +120,166 @@ func main() {
 		return
 	}
 
-	ctx := context.Background()
+	var protocol core.Protocol
 
 	switch config.Type {
 	case "ws":
-		ws.RunWebsocketTest(ctx, config.Addr, config.InitialCount, config.PumpCount, config.Duration)
+		protocol, err = ws.New(config.Addr, config.WS)
+		if err != nil {
+			utils.LogMessage(fmt.Sprintf("Error loading config: %v", err), utils.Fatal_Error_Code)
+			return
+		}
 	case "sse":
-		sse.RunSseTest(ctx, config.Addr, config.InitialCount, config.PumpCount, config.Duration)
+		protocol, err = sse.New(config.Addr, config.SSE)
+		if err != nil {
+			utils.LogMessage(fmt.Sprintf("Error loading config: %v", err), utils.Fatal_Error_Code)
+			return
+		}
 	case "hls":
-		hls.RunHlsTest(ctx, config.Addr, config.InitialCount, config.PumpCount, config.Duration)
+		protocol, err = hls.New(config.Addr, config.HLS)
+		if err != nil {
+			utils.LogMessage(fmt.Sprintf("Error loading config: %v", err), utils.Fatal_Error_Code)
+			return
+		}
 	case "flv":
-		flv.RunFlvTest(ctx, config.Addr, config.InitialCount, config.PumpCount, config.Duration)
+		protocol = flv.New(config.Addr)
 	default:
 		utils.LogMessage(fmt.Sprintf("Unknown connection type: %s. Supported types: ws, sse, hls, flv", config.Type), utils.Fatal_Error_Code)
 	}
+
+	var thresholds []core.Threshold
+	for _, expr := range config.Thresholds {
+		t, err := core.ParseThreshold(expr)
+		if err != nil {
+			utils.LogMessage(fmt.Sprintf("Error loading config: %v", err), utils.Fatal_Error_Code)
+			return
+		}
+		thresholds = append(thresholds, t)
+	}
+
+	profile, err := core.BuildProfile(config.Profile, config.InitialCount, config.PumpCount)
+	if err != nil {
+		utils.LogMessage(fmt.Sprintf("Error loading config: %v", err), utils.Fatal_Error_Code)
+		return
+	}
+
+	progress, err := dashboard.ResolveMode(config.Progress, os.Stdout)
+	if err != nil {
+		utils.LogMessage(fmt.Sprintf("Error loading config: %v", err), utils.Fatal_Error_Code)
+		return
+	}
+
+	var otlp *metrics.OTLP
+	var trace func(core.SessionTrace)
+	if config.OTLP.Endpoint != "" {
+		otlp = metrics.NewOTLP(config.OTLP, config.Name, config.Type)
+		trace = otlp.Span
+	}
+
+	engine := core.NewEngine(core.Options{
+		Addr:           config.Addr,
+		InitialCount:   config.InitialCount,
+		Duration:       time.Second * time.Duration(config.Duration),
+		Profile:        profile,
+		GracePeriod:    time.Duration(config.GracePeriod),
+		SampleInterval: time.Duration(config.SampleInterval),
+		Quiet:          progress == dashboard.ModeTUI,
+		Trace:          trace,
+	}, protocol)
+
+	if otlp != nil {
+		otlp.Start(engine)
+	}
+
+	if config.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.NewPrometheus(config.Type, engine))
+		go func() {
+			utils.LogMessage(fmt.Sprintf("Serving metrics on http://%s/metrics", config.MetricsAddr), utils.Log_Info)
+			if err := http.ListenAndServe(config.MetricsAddr, mux); err != nil {
+				utils.LogMessage(fmt.Sprintf("Metrics listener stopped: %v", err), utils.Debug_Error_Code)
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		cancel(fmt.Errorf("received %v", sig))
+
+		<-signals
+		utils.LogMessage("Second signal received, exiting without report", utils.Fatal_Error_Code)
+	}()
+
+	if config.MaxDuration > 0 {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithTimeoutCause(ctx, time.Duration(config.MaxDuration), errors.New("max_duration reached"))
+		defer cancelDeadline()
+	}
+
+	dash := dashboard.New(progress, os.Stdout, engine.Snapshot, engine.Latest)
+	dash.Start()
+	result := engine.Run(ctx)
+	dash.Stop()
+	if otlp != nil {
+		otlp.Stop()
+	}
+
+	violated := 0
+	for _, t := range thresholds {
+		res := t.Evaluate(result)
+		result.Thresholds = append(result.Thresholds, res)
+		if !res.Passed {
+			violated++
+		}
+	}
+
+	for _, r := range config.Reports {
+		err := report.Write(r, report.Report{Type: config.Type, Addr: config.Addr, Result: result})
+		if err != nil {
+			utils.LogMessage(err.Error(), utils.Debug_Error_Code)
+			continue
+		}
+		utils.LogMessage(fmt.Sprintf("Report written to %s", r.Path), utils.Log_Info)
+	}
+
+	summary := result
+	summary.Series = nil
+	resp, err := json.Marshal(summary)
+	if err != nil {
+		utils.LogMessage(err.Error(), utils.Fatal_Error_Code)
+	}
+	utils.LogMessage(string(resp), utils.Log_Info)
+
+	if skewed := result.Counters[delivery.ClockSkew]; skewed > 0 {
+		utils.LogMessage(fmt.Sprintf("%d messages carried timestamps up to %.1fms ahead of the local clock; delivery_latency is only accurate with synchronized clocks",
+			skewed, result.Latency[delivery.Skew].Max), utils.Log_Warning)
+	}
+
+	for _, t := range result.Thresholds {
+		if t.Passed {
+			continue
+		}
+		detail := fmt.Sprintf("actual %g", t.Actual)
+		if t.Error != "" {
+			detail = t.Error
+		}
+		utils.LogMessage(fmt.Sprintf("Threshold violated: %s (%s)", t.Threshold, detail), utils.Log_Warning)
+	}
+	if violated > 0 {
+		utils.LogMessage(fmt.Sprintf("%d of %d thresholds violated", violated, len(thresholds)), utils.Log_Warning)
+	}
+
+	// A partial run must not pass a CI gate, whatever its thresholds say.
+	if result.Interrupted {
+		utils.LogMessage(fmt.Sprintf("Run interrupted: %s", result.InterruptReason), utils.Log_Warning)
+		os.Exit(interruptedExitCode)
+	}
+	if violated > 0 {
+		os.Exit(thresholdExitCode)
+	}
 }
@@ -1,8 +1,26 @@
 package core
 
 type Result struct {
-	InitialCount int64
-	StopCount    int64
-	Passed       int64
-	Failed       int64
+	Interrupted           bool
+	InterruptReason       string `json:",omitempty"`
+	InitialCount          int64
+	StopCount             int64
+	Passed                int64
+	Failed                int64
+	Dropped               int64 `json:",omitempty"`
+	Active                int64
+	Connects              int64
+	Elapsed               float64
+	BytesReceived         int64
+	MessagesReceived      int64
+	Failures              map[FailureReason]int64 `json:",omitempty"`
+	StatusCodes           map[int]int64           `json:",omitempty"`
+	CloseCodes            map[int]int64           `json:",omitempty"`
+	Errors                map[string]int64        `json:",omitempty"`
+	Counters              map[string]int64        `json:",omitempty"`
+	Values                map[string]CountSummary `json:",omitempty"`
+	Latency               map[string]LatencySummary
+	MessagesPerConnection CountSummary
+	Thresholds            []ThresholdResult `json:",omitempty"`
+	Series                []Sample          `json:",omitempty"`
 }
@@ -0,0 +1,426 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/utils"
+)
+
+const connectGrace = time.Second * 5
+
+// Protocol creates the virtual users an Engine drives.
+type Protocol interface {
+	NewUser(id int64) VirtualUser
+}
+
+// VirtualUser is a single simulated client. Dial establishes the connection,
+// Run consumes it until ctx is done and Close releases it. Returning a *Failure
+// from Dial or Run reports a specific outcome; any other error is classified.
+type VirtualUser interface {
+	Dial(ctx context.Context, m *Meter) error
+	Run(ctx context.Context, m *Meter) error
+	Close() error
+}
+
+// Failure is an error carrying an already classified Outcome.
+type Failure struct {
+	Outcome Outcome
+}
+
+func (f *Failure) Error() string {
+	return f.Outcome.Err
+}
+
+func Error(o Outcome) error {
+	return &Failure{Outcome: o}
+}
+
+const arrivalTick = time.Millisecond * 10
+
+type Options struct {
+	Addr           string
+	InitialCount   int64
+	Duration       time.Duration
+	Profile        Profile
+	GracePeriod    time.Duration
+	SampleInterval time.Duration
+	Quiet          bool
+	Trace          func(SessionTrace)
+}
+
+type Engine struct {
+	opts     Options
+	protocol Protocol
+	stats    *Stats
+	signal   chan Outcome
+	users    context.Context
+	start    time.Time
+	mu       sync.Mutex
+	result   Result
+	series   []Sample
+	wg       sync.WaitGroup
+	nextID   int64
+	sessions atomic.Int64
+	active   atomic.Int64
+	dropped  atomic.Int64
+}
+
+// virtualUser lets the ramp stop a looping user. Retiring it ends its
+// current session at once, as if duration had run out.
+type virtualUser struct {
+	retired atomic.Bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func (v *virtualUser) retire() {
+	v.retired.Store(true)
+	v.cancel()
+}
+
+func NewEngine(opts Options, protocol Protocol) *Engine {
+	return &Engine{
+		opts:     opts,
+		protocol: protocol,
+		stats:    NewStats(),
+		signal:   make(chan Outcome, 10000),
+	}
+}
+
+// Run drives the profile until it completes or ctx is cancelled. On
+// cancellation no new users are started and in-flight users get
+// GracePeriod to finish before they are cancelled; the partial result is
+// returned with Interrupted set.
+func (e *Engine) Run(ctx context.Context) Result {
+	utils.WelComePrint(
+		fmt.Sprintf("Addr Given %v", e.opts.Addr),
+		fmt.Sprintf("Count Given %v", e.opts.InitialCount),
+		fmt.Sprintf("Duration Given %v", e.opts.Duration),
+		fmt.Sprintf("Profile %v", e.opts.Profile.Kind),
+	)
+
+	// Snapshot may already be polled by the dashboard and the metrics handler.
+	e.mu.Lock()
+	e.start = time.Now()
+	e.result = Result{
+		InitialCount: e.opts.InitialCount,
+	}
+	e.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for o := range e.signal {
+			e.mu.Lock()
+			e.result.Record(o)
+			e.mu.Unlock()
+		}
+		close(done)
+	}()
+
+	stopSampling := make(chan struct{})
+	sampled := make(chan struct{})
+	go e.sample(stopSampling, sampled)
+
+	users, cancelUsers := context.WithCancelCause(context.Background())
+	defer cancelUsers(nil)
+	e.users = users
+
+	if e.opts.Profile.Open() {
+		e.arrive(ctx)
+	} else {
+		e.ramp(ctx)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		e.mu.Lock()
+		e.result.Interrupted = true
+		e.result.InterruptReason = context.Cause(ctx).Error()
+		e.mu.Unlock()
+		e.logf("Run interrupted (%v), draining %v in-flight users for up to %v", context.Cause(ctx), e.active.Load(), e.opts.GracePeriod)
+
+		select {
+		case <-drained:
+		case <-time.After(e.opts.GracePeriod):
+			cancelUsers(context.Cause(ctx))
+			<-drained
+		}
+	}
+
+	close(e.signal)
+	<-done
+
+	close(stopSampling)
+	<-sampled
+
+	result := e.Snapshot()
+	result.Series = e.series
+	return result
+}
+
+// Latest returns the most recent sample of the time series, whose latencies
+// cover only the last sample interval.
+func (e *Engine) Latest() (Sample, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.series) == 0 {
+		return Sample{}, false
+	}
+	return e.series[len(e.series)-1], true
+}
+
+func (e *Engine) Stats() *Stats {
+	return e.stats
+}
+
+// Snapshot returns the result aggregated so far; it is safe to call while Run is in progress.
+func (e *Engine) Snapshot() Result {
+	e.mu.Lock()
+	result := e.result
+	result.Failures = copyMap(e.result.Failures)
+	result.StatusCodes = copyMap(e.result.StatusCodes)
+	result.CloseCodes = copyMap(e.result.CloseCodes)
+	result.Errors = copyMap(e.result.Errors)
+	start := e.start
+	e.mu.Unlock()
+
+	result.StopCount = e.sessions.Load()
+	result.Dropped = e.dropped.Load()
+	result.Active = e.active.Load()
+	result.Connects = e.stats.Connects.Load()
+	result.BytesReceived = e.stats.Bytes.Load()
+	result.MessagesReceived = e.stats.Received.Load()
+	result.MessagesPerConnection = e.stats.Messages.Counts()
+	result.Counters = e.stats.Counters()
+	result.Values = e.stats.Values()
+	result.Latency = e.stats.Latency()
+	if !start.IsZero() {
+		result.Elapsed = time.Since(start).Seconds()
+	}
+	return result
+}
+
+func (e *Engine) logf(format string, args ...interface{}) {
+	if !e.opts.Quiet {
+		utils.LogMessage(fmt.Sprintf(format, args...), utils.Log_Info)
+	}
+}
+
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	if m == nil {
+		return nil
+	}
+	out := make(map[K]V, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func (e *Engine) ramp(ctx context.Context) {
+	profile := e.opts.Profile
+	length := profile.length()
+	start := time.Now()
+
+	ticker := time.NewTicker(profile.Interval)
+	defer ticker.Stop()
+
+	var launched int64
+	var active []*virtualUser
+	defer func() {
+		for _, v := range active {
+			v.retired.Store(true)
+		}
+	}()
+
+	for {
+		elapsed := time.Since(start)
+		target := profile.TargetAt(elapsed)
+
+		current := int64(len(active))
+		if !profile.Loop {
+			current = launched
+		}
+
+		if target > current {
+			for i := current; i < target; i++ {
+				v := e.spawn(profile.Loop)
+				if profile.Loop {
+					active = append(active, v)
+				}
+			}
+			launched += target - current
+			e.logf("Users Dispatched %v", target-current)
+		} else if target < current && profile.Loop {
+			for _, v := range active[target:] {
+				v.retire()
+			}
+			active = active[:target]
+			e.logf("Users Retired %v", current-target)
+		}
+
+		if elapsed >= length {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Engine) arrive(ctx context.Context) {
+	profile := e.opts.Profile
+	start := time.Now()
+
+	ticker := time.NewTicker(arrivalTick)
+	defer ticker.Stop()
+
+	next := profile.gap()
+	var dispatched int64
+
+	for {
+		elapsed := time.Since(start)
+
+		for next <= elapsed && next < profile.Length {
+			if profile.MaxActive > 0 && e.active.Load() >= profile.MaxActive {
+				e.dropped.Add(1)
+			} else {
+				e.spawn(false)
+				dispatched++
+			}
+			next += profile.gap()
+		}
+
+		if elapsed >= profile.Length || next >= profile.Length {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+	e.logf("Users Dispatched %v, Dropped %v", dispatched, e.dropped.Load())
+}
+
+func (e *Engine) spawn(loop bool) *virtualUser {
+	ctx := e.users
+	id := e.nextID
+	e.nextID++
+	v := &virtualUser{}
+	v.ctx, v.cancel = context.WithCancel(context.Background())
+
+	e.wg.Add(1)
+	e.active.Add(1)
+	go func() {
+		defer e.active.Add(-1)
+		defer e.wg.Done()
+		defer v.cancel()
+
+		for {
+			e.sessions.Add(1)
+			outcome := e.session(ctx, v.ctx, id)
+			e.signal <- outcome
+
+			if !loop || v.retired.Load() || ctx.Err() != nil {
+				return
+			}
+
+			if !outcome.Passed {
+				select {
+				case <-ctx.Done():
+					return
+				case <-v.ctx.Done():
+					return
+				case <-time.After(e.opts.Profile.Interval):
+				}
+			}
+		}
+	}()
+
+	return v
+}
+
+// session runs one connection of a user. Cancelling retired cuts the run
+// short and the session passes; cancelling ctx fails it with context_cancel.
+func (e *Engine) session(ctx, retired context.Context, id int64) Outcome {
+	meter := NewMeter(e.stats)
+	if e.opts.Trace != nil {
+		meter.trace = newTrace(id)
+		meter.trace.Start = meter.start
+	}
+
+	user := e.protocol.NewUser(id)
+	outcome := e.connect(ctx, retired, user, meter)
+
+	closing := time.Now()
+	user.Close()
+
+	if e.opts.Trace != nil {
+		meter.mu.Lock()
+		trace := *meter.trace
+		trace.Messages = meter.messages
+		meter.mu.Unlock()
+
+		trace.Closing = closing
+		trace.End = time.Now()
+		trace.Outcome = outcome
+		e.opts.Trace(trace)
+	}
+	return outcome
+}
+
+func (e *Engine) connect(ctx, retired context.Context, user VirtualUser, meter *Meter) Outcome {
+	sessionCtx, cancel := context.WithTimeout(ctx, e.opts.Duration+connectGrace)
+	defer cancel()
+
+	if err := user.Dial(sessionCtx, meter); err != nil {
+		return outcomeOf(ctx, err, DialFailure)
+	}
+	meter.Connected()
+	defer meter.Finished()
+
+	runCtx, cancelRun := context.WithTimeout(sessionCtx, e.opts.Duration)
+	defer cancelRun()
+	stop := context.AfterFunc(retired, cancelRun)
+	defer stop()
+
+	err := user.Run(runCtx, meter)
+	if ctx.Err() != nil {
+		return Fail(ReasonContextCancel, context.Cause(ctx))
+	}
+	if err != nil {
+		return outcomeOf(ctx, err, ReadFailure)
+	}
+	return Pass()
+}
+
+func outcomeOf(ctx context.Context, err error, classify func(error) Outcome) Outcome {
+	if ctx.Err() != nil {
+		return Fail(ReasonContextCancel, context.Cause(ctx))
+	}
+
+	var failure *Failure
+	if errors.As(err, &failure) {
+		return failure.Outcome
+	}
+	return classify(err)
+}
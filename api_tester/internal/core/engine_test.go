@@ -0,0 +1,64 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type holdProtocol struct{}
+
+type holdUser struct{}
+
+func (holdProtocol) NewUser(id int64) VirtualUser { return holdUser{} }
+
+func (holdUser) Dial(ctx context.Context, m *Meter) error { return nil }
+
+// Run holds the connection until the session ends, which passes it.
+func (holdUser) Run(ctx context.Context, m *Meter) error {
+	m.Data(1)
+	<-ctx.Done()
+	return nil
+}
+
+func (holdUser) Close() error { return nil }
+
+func TestSnapshotDuringRun(t *testing.T) {
+	profile, err := BuildProfile(ProfileConfig{Interval: Duration(50 * time.Millisecond)}, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(Options{
+		InitialCount:   2,
+		Duration:       200 * time.Millisecond,
+		Profile:        profile,
+		SampleInterval: 20 * time.Millisecond,
+		Quiet:          true,
+	}, holdProtocol{})
+
+	// The dashboard and the metrics handler poll Snapshot from the start.
+	stop := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				e.Snapshot()
+			}
+		}
+	}()
+
+	result := e.Run(context.Background())
+	close(stop)
+	<-polled
+
+	if result.Passed != 6 || result.Failed != 0 || result.Interrupted {
+		t.Errorf("passed %d failed %d interrupted %v, want 6 passed", result.Passed, result.Failed, result.Interrupted)
+	}
+	if result.Elapsed <= 0 {
+		t.Errorf("elapsed = %v", result.Elapsed)
+	}
+}
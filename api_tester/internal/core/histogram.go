@@ -0,0 +1,164 @@
+package core
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	subBucketBits  = 7
+	subBucketCount = 1 << subBucketBits
+	subBucketHalf  = subBucketCount / 2
+	bucketCount    = subBucketCount + (64-subBucketBits)*subBucketHalf
+)
+
+// Histogram is a lock-free log-linear histogram in the spirit of HDR
+// histograms: values below 128 are exact, larger values keep ~1.5% precision.
+type Histogram struct {
+	counts [bucketCount]atomic.Uint64
+	total  atomic.Uint64
+	sum    atomic.Int64
+	min    atomic.Int64
+	max    atomic.Int64
+}
+
+type CountSummary struct {
+	Count int64
+	Min   int64
+	P50   int64
+	P90   int64
+	P99   int64
+	Max   int64
+}
+
+type LatencySummary struct {
+	Count int64
+	P50   float64
+	P90   float64
+	P99   float64
+	P999  float64
+	Max   float64
+}
+
+func NewHistogram() *Histogram {
+	h := &Histogram{}
+	h.min.Store(math.MaxInt64)
+	return h
+}
+
+func bucketIndex(v int64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - subBucketBits
+	return subBucketCount + (shift-1)*subBucketHalf + int(v>>shift) - subBucketHalf
+}
+
+func bucketUpperBound(idx int) int64 {
+	if idx < subBucketCount {
+		return int64(idx)
+	}
+	shift := (idx-subBucketCount)/subBucketHalf + 1
+	sub := int64((idx-subBucketCount)%subBucketHalf + subBucketHalf)
+	return (sub+1)<<shift - 1
+}
+
+func (h *Histogram) Record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	h.counts[bucketIndex(v)].Add(1)
+	h.total.Add(1)
+	h.sum.Add(v)
+
+	for cur := h.min.Load(); v < cur && !h.min.CompareAndSwap(cur, v); cur = h.min.Load() {
+	}
+	for cur := h.max.Load(); v > cur && !h.max.CompareAndSwap(cur, v); cur = h.max.Load() {
+	}
+}
+
+func (h *Histogram) RecordDuration(d time.Duration) {
+	h.Record(d.Microseconds())
+}
+
+func (h *Histogram) Count() int64 {
+	return int64(h.total.Load())
+}
+
+func (h *Histogram) Sum() int64 {
+	return h.sum.Load()
+}
+
+// CountAtOrBelow returns how many recorded values fall into buckets whose upper bound is at most v.
+func (h *Histogram) CountAtOrBelow(v int64) int64 {
+	var n uint64
+	for i := 0; i <= bucketIndex(v) && i < bucketCount; i++ {
+		if bucketUpperBound(i) > v {
+			break
+		}
+		n += h.counts[i].Load()
+	}
+	return int64(n)
+}
+
+func (h *Histogram) Min() int64 {
+	if h.Count() == 0 {
+		return 0
+	}
+	return h.min.Load()
+}
+
+func (h *Histogram) Max() int64 {
+	return h.max.Load()
+}
+
+func (h *Histogram) Quantile(q float64) int64 {
+	total := h.total.Load()
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(q * float64(total)))
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i := range h.counts {
+		seen += h.counts[i].Load()
+		if seen >= rank {
+			return min(bucketUpperBound(i), h.Max())
+		}
+	}
+	return h.Max()
+}
+
+// Summary reports the percentiles of a histogram holding microseconds as milliseconds.
+func (h *Histogram) Summary() LatencySummary {
+	ms := func(us int64) float64 {
+		return math.Round(float64(us)) / 1000
+	}
+
+	return LatencySummary{
+		Count: h.Count(),
+		P50:   ms(h.Quantile(0.50)),
+		P90:   ms(h.Quantile(0.90)),
+		P99:   ms(h.Quantile(0.99)),
+		P999:  ms(h.Quantile(0.999)),
+		Max:   ms(h.Max()),
+	}
+}
+
+// Counts reports the percentiles of a histogram holding plain counts.
+func (h *Histogram) Counts() CountSummary {
+	return CountSummary{
+		Count: h.Count(),
+		Min:   h.Min(),
+		P50:   h.Quantile(0.50),
+		P90:   h.Quantile(0.90),
+		P99:   h.Quantile(0.99),
+		Max:   h.Max(),
+	}
+}
@@ -0,0 +1,107 @@
+package core
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBucketIndex(t *testing.T) {
+	for v := int64(0); v < subBucketCount; v++ {
+		if idx := bucketIndex(v); bucketUpperBound(idx) != v {
+			t.Fatalf("value %d: bucket %d upper bound %d, want exact", v, idx, bucketUpperBound(idx))
+		}
+	}
+
+	for _, v := range []int64{128, 129, 255, 256, 1000, 4095, 4096, 123456, 1 << 40, 1<<62 + 12345} {
+		idx := bucketIndex(v)
+		if idx < 0 || idx >= bucketCount {
+			t.Fatalf("value %d: bucket %d out of range", v, idx)
+		}
+		upper := bucketUpperBound(idx)
+		if upper < v {
+			t.Errorf("value %d: upper bound %d is below the value", v, upper)
+		}
+		if float64(upper-v) > float64(v)/subBucketHalf {
+			t.Errorf("value %d: upper bound %d is more than 1/%d off", v, upper, subBucketHalf)
+		}
+		if idx > 0 && bucketUpperBound(idx-1) >= v {
+			t.Errorf("value %d: previous bucket %d already covers it", v, idx-1)
+		}
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []int64
+	}{
+		{name: "exact", values: []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{name: "single", values: []int64{4321}},
+		{name: "sequence", values: sequence(1, 10000)},
+		{name: "random", values: randomValues(20000, 5_000_000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHistogram()
+			for _, v := range tt.values {
+				h.Record(v)
+			}
+			sorted := append([]int64(nil), tt.values...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+			for _, q := range []float64{0.5, 0.9, 0.99, 0.999, 1} {
+				rank := int(float64(len(sorted))*q+0.999999) - 1
+				want := sorted[max(rank, 0)]
+				got := h.Quantile(q)
+				if got < want || float64(got-want) > float64(want)*0.016 {
+					t.Errorf("p%v = %d, want %d within 1.5%%", q*100, got, want)
+				}
+			}
+
+			if h.Count() != int64(len(sorted)) || h.Min() != sorted[0] || h.Max() != sorted[len(sorted)-1] {
+				t.Errorf("count %d min %d max %d, want %d %d %d",
+					h.Count(), h.Min(), h.Max(), len(sorted), sorted[0], sorted[len(sorted)-1])
+			}
+		})
+	}
+}
+
+func TestHistogramEmpty(t *testing.T) {
+	h := NewHistogram()
+	if h.Quantile(0.99) != 0 || h.Min() != 0 || h.Max() != 0 {
+		t.Errorf("empty histogram reported p99 %d min %d max %d", h.Quantile(0.99), h.Min(), h.Max())
+	}
+}
+
+func TestHistogramSummary(t *testing.T) {
+	h := NewHistogram()
+	for i := 0; i < 100; i++ {
+		h.RecordDuration(100 * time.Microsecond)
+	}
+	h.RecordDuration(2 * time.Second)
+
+	s := h.Summary()
+	if s.Count != 101 || s.P50 != 0.1 || s.P99 != 0.1 || s.Max != 2000 {
+		t.Errorf("summary %+v", s)
+	}
+}
+
+func sequence(from, to int64) []int64 {
+	var values []int64
+	for v := from; v <= to; v++ {
+		values = append(values, v)
+	}
+	return values
+}
+
+func randomValues(n int, limit int64) []int64 {
+	r := rand.New(rand.NewSource(1))
+	values := make([]int64, n)
+	for i := range values {
+		values[i] = r.Int63n(limit)
+	}
+	return values
+}
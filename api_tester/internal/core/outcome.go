@@ -0,0 +1,151 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+type FailureReason string
+
+const (
+	ReasonDial          FailureReason = "dial"
+	ReasonHandshake     FailureReason = "handshake"
+	ReasonHTTPStatus    FailureReason = "http_status"
+	ReasonProtocol      FailureReason = "protocol"
+	ReasonIdleTimeout   FailureReason = "idle_timeout"
+	ReasonServerClose   FailureReason = "server_close"
+	ReasonContextCancel FailureReason = "context_cancel"
+	ReasonClient        FailureReason = "client"
+)
+
+const maxDistinctErrors = 20
+
+// Outcome is the event every virtual user reports exactly once when it finishes.
+type Outcome struct {
+	Passed     bool
+	Reason     FailureReason
+	StatusCode int
+	CloseCode  int
+	Err        string
+}
+
+func Pass() Outcome {
+	return Outcome{Passed: true}
+}
+
+func Fail(reason FailureReason, err error) Outcome {
+	o := Outcome{Reason: reason}
+	if err != nil {
+		o.Err = err.Error()
+	}
+	return o
+}
+
+func FailStatus(code int) Outcome {
+	return Outcome{
+		Reason:     ReasonHTTPStatus,
+		StatusCode: code,
+		Err:        fmt.Sprintf("unexpected http status %d", code),
+	}
+}
+
+func FailClose(code int, reason string) Outcome {
+	return Outcome{
+		Reason:    ReasonServerClose,
+		CloseCode: code,
+		Err:       fmt.Sprintf("server closed connection: %d %s", code, reason),
+	}
+}
+
+// Closed is the outcome of a connection the server ended with a close frame:
+// a normal closure (1000) passes, any other code fails with server_close.
+func Closed(code int, reason string) Outcome {
+	if code == 1000 {
+		return Outcome{Passed: true, CloseCode: code}
+	}
+	return FailClose(code, reason)
+}
+
+// DialFailure classifies an error returned while establishing a connection.
+// Cancellation of the engine context is handled before classification, so a
+// deadline here is the session timing out, for example on a stalled handshake.
+func DialFailure(err error) Outcome {
+	var (
+		recordErr  tls.RecordHeaderError
+		alertErr   tls.AlertError
+		certErr    *tls.CertificateVerificationError
+		unknownErr x509.UnknownAuthorityError
+		hostErr    x509.HostnameError
+	)
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return Fail(ReasonContextCancel, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return Fail(ReasonDial, err)
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &certErr),
+		errors.As(err, &unknownErr), errors.As(err, &hostErr):
+		return Fail(ReasonHandshake, err)
+	default:
+		return Fail(ReasonDial, err)
+	}
+}
+
+// ReadFailure classifies an error returned while reading from an established connection.
+func ReadFailure(err error) Outcome {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return Fail(ReasonContextCancel, err)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return Fail(ReasonIdleTimeout, err)
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return Fail(ReasonServerClose, err)
+	default:
+		return Fail(ReasonProtocol, err)
+	}
+}
+
+func (r *Result) Record(o Outcome) {
+	if o.CloseCode != 0 {
+		if r.CloseCodes == nil {
+			r.CloseCodes = make(map[int]int64)
+		}
+		r.CloseCodes[o.CloseCode]++
+	}
+
+	if o.Passed {
+		r.Passed++
+		return
+	}
+
+	r.Failed++
+	if r.Failures == nil {
+		r.Failures = make(map[FailureReason]int64)
+	}
+	r.Failures[o.Reason]++
+
+	if o.StatusCode != 0 {
+		if r.StatusCodes == nil {
+			r.StatusCodes = make(map[int]int64)
+		}
+		r.StatusCodes[o.StatusCode]++
+	}
+
+	if o.Err != "" {
+		if r.Errors == nil {
+			r.Errors = make(map[string]int64)
+		}
+		if _, ok := r.Errors[o.Err]; ok || len(r.Errors) < maxDistinctErrors {
+			r.Errors[o.Err]++
+		}
+	}
+}
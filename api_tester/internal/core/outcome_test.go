@@ -0,0 +1,59 @@
+package core
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestReadFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want FailureReason
+	}{
+		{"eof", io.EOF, ReasonServerClose},
+		{"unexpected eof", fmt.Errorf("read body: %w", io.ErrUnexpectedEOF), ReasonServerClose},
+		{"closed", net.ErrClosed, ReasonServerClose},
+		{"reset", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, ReasonServerClose},
+		{"broken pipe", &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}, ReasonServerClose},
+		{"timeout", &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, ReasonIdleTimeout},
+		{"session deadline", fmt.Errorf("read: %w", context.DeadlineExceeded), ReasonIdleTimeout},
+		{"cancel", context.Canceled, ReasonContextCancel},
+		{"garbage", errors.New("invalid frame"), ReasonProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ReadFailure(tt.err).Reason; got != tt.want {
+				t.Errorf("ReadFailure(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want FailureReason
+	}{
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, ReasonDial},
+		{"session deadline", &net.OpError{Op: "dial", Err: context.DeadlineExceeded}, ReasonDial},
+		{"stalled upgrade", fmt.Errorf("upgrade: %w", context.DeadlineExceeded), ReasonDial},
+		{"certificate", x509.UnknownAuthorityError{}, ReasonHandshake},
+		{"cancel", context.Canceled, ReasonContextCancel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DialFailure(tt.err).Reason; got != tt.want {
+				t.Errorf("DialFailure(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
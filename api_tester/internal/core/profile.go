@@ -0,0 +1,257 @@
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	ProfilePump        = "pump"
+	ProfileLinear      = "linear"
+	ProfileStep        = "step"
+	ProfileSpike       = "spike"
+	ProfileSoak        = "soak"
+	ProfileRampDown    = "ramp_down"
+	ProfileStages      = "stages"
+	ProfileArrivalRate = "arrival_rate"
+)
+
+// Duration accepts either a Go duration string ("90s", "5m") or a number of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var seconds int64
+	if err := unmarshal(&seconds); err == nil {
+		*d = Duration(time.Duration(seconds) * time.Second)
+		return nil
+	}
+
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", s, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type StageConfig struct {
+	Target int64    `yaml:"target"`
+	Ramp   Duration `yaml:"ramp"`
+	Hold   Duration `yaml:"hold"`
+}
+
+type ProfileConfig struct {
+	Type      string        `yaml:"type"`
+	Interval  Duration      `yaml:"interval"`
+	Start     int64         `yaml:"start"`
+	Target    int64         `yaml:"target"`
+	Step      int64         `yaml:"step"`
+	Steps     int64         `yaml:"steps"`
+	Spike     int64         `yaml:"spike"`
+	Rate      float64       `yaml:"rate"`
+	Poisson   bool          `yaml:"poisson"`
+	MaxActive int64         `yaml:"max_in_flight"`
+	Ramp      Duration      `yaml:"ramp"`
+	Hold      Duration      `yaml:"hold"`
+	SpikeHold Duration      `yaml:"spike_hold"`
+	RampDown  Duration      `yaml:"ramp_down"`
+	Stages    []StageConfig `yaml:"stages"`
+}
+
+// Stage ramps the number of virtual users linearly from the previous target
+// to Target over Ramp, then keeps it there for Hold.
+type Stage struct {
+	Target int64
+	Ramp   time.Duration
+	Hold   time.Duration
+}
+
+// Profile is the compiled schedule an Engine follows. Closed-model profiles
+// keep the number of virtual users on the Stages curve; when Loop is set each
+// user reconnects after its session ends, otherwise users run a single
+// session and the curve counts launched users. Open-model profiles launch new
+// users at Rate per second for Length regardless of how many are active,
+// dropping arrivals while MaxActive users are already in flight.
+type Profile struct {
+	Kind      string
+	Interval  time.Duration
+	Stages    []Stage
+	Loop      bool
+	Rate      float64
+	Poisson   bool
+	MaxActive int64
+	Length    time.Duration
+}
+
+func BuildProfile(cfg ProfileConfig, initialCount int64, pumpCount int64) (Profile, error) {
+	profile := Profile{
+		Kind:     cfg.Type,
+		Interval: time.Duration(cfg.Interval),
+		Loop:     true,
+	}
+	if profile.Kind == "" {
+		profile.Kind = ProfilePump
+	}
+	if profile.Interval <= 0 {
+		profile.Interval = time.Second
+	}
+
+	ramp := time.Duration(cfg.Ramp)
+	hold := time.Duration(cfg.Hold)
+
+	switch profile.Kind {
+	case ProfilePump:
+		if initialCount <= 0 {
+			return profile, fmt.Errorf("initial_count must be greater than 0")
+		}
+		if pumpCount <= 0 {
+			return profile, fmt.Errorf("pump_count must be greater than 0")
+		}
+		profile.Loop = false
+		launched, count := int64(0), initialCount
+		for i := int64(0); i <= pumpCount; i++ {
+			launched += count
+			profile.Stages = append(profile.Stages, Stage{Target: launched, Hold: profile.Interval})
+			count = count * 2
+		}
+		profile.Stages[len(profile.Stages)-1].Hold = 0
+
+	case ProfileLinear:
+		if cfg.Target <= 0 {
+			return profile, fmt.Errorf("profile target must be greater than 0")
+		}
+		profile.Stages = []Stage{
+			{Target: cfg.Start},
+			{Target: cfg.Target, Ramp: ramp, Hold: hold},
+		}
+
+	case ProfileStep:
+		if cfg.Step <= 0 || cfg.Steps <= 0 {
+			return profile, fmt.Errorf("profile step and steps must be greater than 0")
+		}
+		if hold <= 0 {
+			return profile, fmt.Errorf("profile hold must be greater than 0")
+		}
+		profile.Stages = []Stage{{Target: cfg.Start}}
+		for i := int64(1); i <= cfg.Steps; i++ {
+			profile.Stages = append(profile.Stages, Stage{Target: cfg.Start + i*cfg.Step, Ramp: ramp, Hold: hold})
+		}
+
+	case ProfileSpike:
+		if cfg.Spike <= cfg.Start {
+			return profile, fmt.Errorf("profile spike must be greater than start")
+		}
+		profile.Stages = []Stage{
+			{Target: cfg.Start, Ramp: ramp, Hold: hold},
+			{Target: cfg.Spike, Hold: time.Duration(cfg.SpikeHold)},
+			{Target: cfg.Start, Hold: hold},
+		}
+
+	case ProfileSoak:
+		if cfg.Target <= 0 || hold <= 0 {
+			return profile, fmt.Errorf("profile target and hold must be greater than 0")
+		}
+		rampDown := time.Duration(cfg.RampDown)
+		if rampDown <= 0 {
+			rampDown = ramp
+		}
+		profile.Stages = []Stage{
+			{Target: cfg.Target, Ramp: ramp, Hold: hold},
+			{Target: 0, Ramp: rampDown},
+		}
+
+	case ProfileRampDown:
+		if cfg.Target <= 0 || cfg.RampDown <= 0 {
+			return profile, fmt.Errorf("profile target and ramp_down must be greater than 0")
+		}
+		profile.Stages = []Stage{
+			{Target: cfg.Target, Ramp: ramp, Hold: hold},
+			{Target: 0, Ramp: time.Duration(cfg.RampDown)},
+		}
+
+	case ProfileStages:
+		if len(cfg.Stages) == 0 {
+			return profile, fmt.Errorf("profile stages must not be empty")
+		}
+		for _, s := range cfg.Stages {
+			profile.Stages = append(profile.Stages, Stage{Target: s.Target, Ramp: time.Duration(s.Ramp), Hold: time.Duration(s.Hold)})
+		}
+
+	case ProfileArrivalRate:
+		if cfg.Rate <= 0 || hold <= 0 {
+			return profile, fmt.Errorf("profile rate and hold must be greater than 0")
+		}
+		if cfg.MaxActive < 0 {
+			return profile, fmt.Errorf("profile max_in_flight must not be negative")
+		}
+		profile.Loop = false
+		profile.Rate = cfg.Rate
+		profile.Poisson = cfg.Poisson
+		profile.MaxActive = cfg.MaxActive
+		profile.Length = hold
+
+	default:
+		return profile, fmt.Errorf("unknown profile type: %s", profile.Kind)
+	}
+
+	for _, s := range profile.Stages {
+		if s.Target < 0 {
+			return profile, fmt.Errorf("profile targets must not be negative")
+		}
+	}
+
+	return profile, nil
+}
+
+func (p Profile) Open() bool {
+	return p.Rate > 0
+}
+
+// gap returns the time until the next arrival of an open-model profile.
+func (p Profile) gap() time.Duration {
+	seconds := 1 / p.Rate
+	if p.Poisson {
+		seconds = rand.ExpFloat64() / p.Rate
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Length of a closed-model profile is the sum of its ramps and holds.
+func (p Profile) length() time.Duration {
+	if p.Open() {
+		return p.Length
+	}
+
+	var total time.Duration
+	for _, s := range p.Stages {
+		total += s.Ramp + s.Hold
+	}
+	return total
+}
+
+func (p Profile) TargetAt(elapsed time.Duration) int64 {
+	var previous int64
+
+	for _, s := range p.Stages {
+		if elapsed < s.Ramp {
+			progress := float64(elapsed) / float64(s.Ramp)
+			return previous + int64(float64(s.Target-previous)*progress)
+		}
+		elapsed -= s.Ramp
+
+		if elapsed < s.Hold {
+			return s.Target
+		}
+		elapsed -= s.Hold
+
+		previous = s.Target
+	}
+
+	return previous
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTargetAt(t *testing.T) {
+	s := time.Second
+	tests := []struct {
+		name    string
+		cfg     ProfileConfig
+		initial int64
+		pump    int64
+		length  time.Duration
+		targets map[time.Duration]int64
+	}{
+		{
+			name:    "pump",
+			cfg:     ProfileConfig{Interval: Duration(s)},
+			initial: 5,
+			pump:    2,
+			length:  2 * s,
+			targets: map[time.Duration]int64{0: 5, s: 15, 2 * s: 35, 10 * s: 35},
+		},
+		{
+			name:    "linear",
+			cfg:     ProfileConfig{Type: ProfileLinear, Start: 10, Target: 110, Ramp: Duration(10 * s), Hold: Duration(5 * s)},
+			length:  15 * s,
+			targets: map[time.Duration]int64{0: 10, 5 * s: 60, 10 * s: 110, 14 * s: 110, 20 * s: 110},
+		},
+		{
+			name:    "step",
+			cfg:     ProfileConfig{Type: ProfileStep, Step: 10, Steps: 3, Hold: Duration(2 * s)},
+			length:  6 * s,
+			targets: map[time.Duration]int64{0: 10, s: 10, 2 * s: 20, 5 * s: 30},
+		},
+		{
+			name:    "spike",
+			cfg:     ProfileConfig{Type: ProfileSpike, Start: 10, Spike: 100, Hold: Duration(3 * s), SpikeHold: Duration(s)},
+			length:  7 * s,
+			targets: map[time.Duration]int64{0: 10, 2 * s: 10, 3 * s: 100, 4 * s: 10, 6 * s: 10},
+		},
+		{
+			name:    "soak",
+			cfg:     ProfileConfig{Type: ProfileSoak, Target: 40, Ramp: Duration(4 * s), Hold: Duration(10 * s)},
+			length:  18 * s,
+			targets: map[time.Duration]int64{s: 10, 4 * s: 40, 13 * s: 40, 16 * s: 20, 18 * s: 0},
+		},
+		{
+			name:    "ramp down",
+			cfg:     ProfileConfig{Type: ProfileRampDown, Target: 100, Hold: Duration(2 * s), RampDown: Duration(10 * s)},
+			length:  12 * s,
+			targets: map[time.Duration]int64{0: 100, 2 * s: 100, 7 * s: 50, 11 * s: 10, 12 * s: 0},
+		},
+		{
+			name: "stages",
+			cfg: ProfileConfig{Type: ProfileStages, Stages: []StageConfig{
+				{Target: 20, Ramp: Duration(2 * s)},
+				{Target: 20, Hold: Duration(s)},
+				{Target: 0, Ramp: Duration(2 * s)},
+			}},
+			length:  5 * s,
+			targets: map[time.Duration]int64{s: 10, 2 * s: 20, 3 * s: 20, 4 * s: 10, 5 * s: 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := BuildProfile(tt.cfg, tt.initial, tt.pump)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.length() != tt.length {
+				t.Errorf("length = %v, want %v", p.length(), tt.length)
+			}
+			for elapsed, want := range tt.targets {
+				if got := p.TargetAt(elapsed); got != want {
+					t.Errorf("TargetAt(%v) = %d, want %d", elapsed, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildProfileInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ProfileConfig
+	}{
+		{name: "unknown", cfg: ProfileConfig{Type: "sawtooth"}},
+		{name: "pump without counts", cfg: ProfileConfig{Type: ProfilePump}},
+		{name: "linear without target", cfg: ProfileConfig{Type: ProfileLinear}},
+		{name: "step without hold", cfg: ProfileConfig{Type: ProfileStep, Step: 1, Steps: 1}},
+		{name: "spike below start", cfg: ProfileConfig{Type: ProfileSpike, Start: 10, Spike: 5}},
+		{name: "ramp down without ramp_down", cfg: ProfileConfig{Type: ProfileRampDown, Target: 10}},
+		{name: "empty stages", cfg: ProfileConfig{Type: ProfileStages}},
+		{name: "negative stage", cfg: ProfileConfig{Type: ProfileStages, Stages: []StageConfig{{Target: -1}}}},
+		{name: "arrival rate without hold", cfg: ProfileConfig{Type: ProfileArrivalRate, Rate: 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := BuildProfile(tt.cfg, 0, 0); err == nil {
+				t.Error("built the profile, want an error")
+			}
+		})
+	}
+}
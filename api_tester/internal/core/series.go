@@ -0,0 +1,88 @@
+package core
+
+import "time"
+
+const defaultSampleInterval = time.Second
+
+// Sample is a point of the run's time series. The cumulative counters match
+// the final Result; the New*, *PerSec and Latency fields only cover the window
+// since the previous sample.
+type Sample struct {
+	Elapsed        float64
+	Target         int64 `json:",omitempty"`
+	Active         int64
+	Connects       int64
+	Passed         int64
+	Failed         int64
+	Bytes          int64
+	Messages       int64
+	NewConnects    int64
+	NewFailures    map[FailureReason]int64 `json:",omitempty"`
+	BytesPerSec    float64
+	MessagesPerSec float64
+	Latency        map[string]LatencySummary
+}
+
+func (e *Engine) sample(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	interval := e.opts.SampleInterval
+	if interval <= 0 {
+		interval = defaultSampleInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var previous Result
+	for {
+		select {
+		case <-stop:
+			e.record(&previous)
+			return
+		case <-ticker.C:
+			e.record(&previous)
+		}
+	}
+}
+
+func (e *Engine) record(previous *Result) {
+	current := e.Snapshot()
+	seconds := current.Elapsed - previous.Elapsed
+
+	s := Sample{
+		Elapsed:     current.Elapsed,
+		Active:      current.Active,
+		Connects:    current.Connects,
+		Passed:      current.Passed,
+		Failed:      current.Failed,
+		Bytes:       current.BytesReceived,
+		Messages:    current.MessagesReceived,
+		NewConnects: current.Connects - previous.Connects,
+		Latency:     e.stats.Window(),
+	}
+
+	if !e.opts.Profile.Open() {
+		s.Target = e.opts.Profile.TargetAt(time.Duration(current.Elapsed * float64(time.Second)))
+	}
+
+	if seconds > 0 {
+		s.BytesPerSec = float64(current.BytesReceived-previous.BytesReceived) / seconds
+		s.MessagesPerSec = float64(current.MessagesReceived-previous.MessagesReceived) / seconds
+	}
+
+	for reason, count := range current.Failures {
+		if delta := count - previous.Failures[reason]; delta > 0 {
+			if s.NewFailures == nil {
+				s.NewFailures = make(map[FailureReason]int64)
+			}
+			s.NewFailures[reason] = delta
+		}
+	}
+
+	*previous = current
+
+	e.mu.Lock()
+	e.series = append(e.series, s)
+	e.mu.Unlock()
+}
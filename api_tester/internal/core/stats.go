@@ -0,0 +1,286 @@
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ConnectTime  = "connect_time"
+	FirstData    = "first_data"
+	InterArrival = "inter_arrival"
+
+	// StalledMs and PlayedMs are the watch time counters of protocols that
+	// simulate a player; rebuffer_ratio is derived from them.
+	StalledMs = "stalled_ms"
+	PlayedMs  = "played_ms"
+)
+
+// Stats collects the latency histograms and counters shared by every virtual
+// user of a run. Every latency is kept twice: for the whole run and for the
+// current sampling window, which Window swaps out. The window histograms are
+// guarded by mu so no record lands in a window after it was summarised.
+type Stats struct {
+	Messages  *Histogram
+	Connects  atomic.Int64
+	Bytes     atomic.Int64
+	Received  atomic.Int64
+	mu        sync.RWMutex
+	latencies map[string]*latency
+	counters  map[string]*atomic.Int64
+	values    map[string]*Histogram
+}
+
+type latency struct {
+	total  *Histogram
+	window *Histogram
+}
+
+func NewStats() *Stats {
+	s := &Stats{
+		Messages:  NewHistogram(),
+		latencies: make(map[string]*latency),
+		counters:  make(map[string]*atomic.Int64),
+		values:    make(map[string]*Histogram),
+	}
+	for _, name := range []string{ConnectTime, FirstData, InterArrival} {
+		s.latency(name)
+	}
+	return s
+}
+
+func (s *Stats) latency(name string) *latency {
+	s.mu.RLock()
+	l, ok := s.latencies[name]
+	s.mu.RUnlock()
+	if ok {
+		return l
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l, ok := s.latencies[name]; ok {
+		return l
+	}
+	l = &latency{total: NewHistogram(), window: NewHistogram()}
+	s.latencies[name] = l
+	return l
+}
+
+// Observe records d into the named latency histogram, creating it on first use.
+func (s *Stats) Observe(name string, d time.Duration) {
+	l := s.latency(name)
+	l.total.RecordDuration(d)
+
+	s.mu.RLock()
+	l.window.RecordDuration(d)
+	s.mu.RUnlock()
+}
+
+func (s *Stats) Latency() map[string]LatencySummary {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make(map[string]LatencySummary, len(s.latencies))
+	for name, l := range s.latencies {
+		out[name] = l.total.Summary()
+	}
+	return out
+}
+
+// Histograms returns the whole-run histogram of every latency.
+func (s *Stats) Histograms() map[string]*Histogram {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make(map[string]*Histogram, len(s.latencies))
+	for name, l := range s.latencies {
+		out[name] = l.total
+	}
+	return out
+}
+
+// Window returns the latencies recorded since the previous call and starts a new window.
+func (s *Stats) Window() map[string]LatencySummary {
+	s.mu.Lock()
+	windows := make(map[string]*Histogram, len(s.latencies))
+	for name, l := range s.latencies {
+		windows[name] = l.window
+		l.window = NewHistogram()
+	}
+	s.mu.Unlock()
+
+	out := make(map[string]LatencySummary, len(windows))
+	for name, h := range windows {
+		out[name] = h.Summary()
+	}
+	return out
+}
+
+// Count adds n to the named event counter, creating it on first use.
+func (s *Stats) Count(name string, n int64) {
+	s.mu.RLock()
+	c, ok := s.counters[name]
+	s.mu.RUnlock()
+
+	if !ok {
+		s.mu.Lock()
+		if c, ok = s.counters[name]; !ok {
+			c = &atomic.Int64{}
+			s.counters[name] = c
+		}
+		s.mu.Unlock()
+	}
+	c.Add(n)
+}
+
+// Record adds v to the named value histogram, creating it on first use.
+func (s *Stats) Record(name string, v int64) {
+	s.mu.RLock()
+	h, ok := s.values[name]
+	s.mu.RUnlock()
+
+	if !ok {
+		s.mu.Lock()
+		if h, ok = s.values[name]; !ok {
+			h = NewHistogram()
+			s.values[name] = h
+		}
+		s.mu.Unlock()
+	}
+	h.Record(v)
+}
+
+// Values returns the distribution of every value histogram, or nil when none were used.
+func (s *Stats) Values() map[string]CountSummary {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.values) == 0 {
+		return nil
+	}
+	out := make(map[string]CountSummary, len(s.values))
+	for name, h := range s.values {
+		out[name] = h.Counts()
+	}
+	return out
+}
+
+// Counters returns the event counters, or nil when none were used.
+func (s *Stats) Counters() map[string]int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.counters) == 0 {
+		return nil
+	}
+	out := make(map[string]int64, len(s.counters))
+	for name, c := range s.counters {
+		out[name] = c.Load()
+	}
+	return out
+}
+
+// Meter tracks the timings of a single connection and feeds them into Stats.
+type Meter struct {
+	stats    *Stats
+	mu       sync.Mutex
+	start    time.Time
+	lastData time.Time
+	messages int64
+	trace    *SessionTrace
+}
+
+func NewMeter(stats *Stats) *Meter {
+	return &Meter{
+		stats: stats,
+		start: time.Now(),
+	}
+}
+
+// Dialed marks the end of the transport connect, splitting Dial into a dial
+// and a handshake phase in traces. Protocols without a handshake skip it.
+func (m *Meter) Dialed() {
+	if m.trace == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.trace.Dialed = time.Now()
+}
+
+// Traceparent returns the W3C trace context header for the session, or "" when tracing is off.
+func (m *Meter) Traceparent() string {
+	if m.trace == nil {
+		return ""
+	}
+	return m.trace.Traceparent()
+}
+
+func (m *Meter) Connected() {
+	now := time.Now()
+	m.stats.Connects.Add(1)
+	m.stats.Observe(ConnectTime, now.Sub(m.start))
+
+	if m.trace != nil {
+		m.mu.Lock()
+		m.trace.Connected = now
+		m.mu.Unlock()
+	}
+}
+
+// Data records one received message of n bytes.
+func (m *Meter) Data(n int) {
+	m.stats.Received.Add(1)
+	m.stats.Bytes.Add(int64(n))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages++
+
+	now := time.Now()
+	if m.lastData.IsZero() {
+		m.stats.Observe(FirstData, now.Sub(m.start))
+		if m.trace != nil {
+			m.trace.FirstData = now
+		}
+	} else {
+		m.stats.Observe(InterArrival, now.Sub(m.lastData))
+	}
+	m.lastData = now
+}
+
+// Finished records how many messages the connection received in total.
+func (m *Meter) Finished() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stats.Messages.Record(m.messages)
+}
+
+// Observe records a protocol specific latency such as a round trip.
+func (m *Meter) Observe(name string, d time.Duration) {
+	m.stats.Observe(name, d)
+}
+
+// Count adds n to a protocol specific event counter such as timeouts or reconnects.
+func (m *Meter) Count(name string, n int64) {
+	m.stats.Count(name, n)
+}
+
+// Register creates event counters at zero, so that they are reported and
+// can be used in thresholds even when the event never happens.
+func (m *Meter) Register(names ...string) {
+	for _, name := range names {
+		m.stats.Count(name, 0)
+	}
+}
+
+// Record adds a plain value, such as a throughput, to the named distribution.
+func (m *Meter) Record(name string, v int64) {
+	m.stats.Record(name, v)
+}
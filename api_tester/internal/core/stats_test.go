@@ -0,0 +1,43 @@
+package core
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWindowKeepsEveryRecord(t *testing.T) {
+	s := NewStats()
+	const writers, records = 8, 2000
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < records; j++ {
+				s.Observe(ConnectTime, time.Millisecond)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var windowed int64
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		windowed += s.Window()[ConnectTime].Count
+	}
+
+	if total := s.Latency()[ConnectTime].Count; windowed != total || total != writers*records {
+		t.Errorf("windows recorded %d, whole run %d, want %d", windowed, total, writers*records)
+	}
+}
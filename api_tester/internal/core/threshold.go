@@ -0,0 +1,183 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Threshold is a pass/fail rule such as "connect_time.p99 < 500ms" evaluated
+// against the final Result. Durations compare in milliseconds and a trailing
+// "%" divides the value by 100.
+type Threshold struct {
+	Expr   string
+	Metric string
+	Op     string
+	Value  float64
+}
+
+type ThresholdResult struct {
+	Threshold string
+	Actual    float64
+	Passed    bool
+	Error     string `json:",omitempty"`
+}
+
+var thresholdOps = []string{"<=", ">=", "==", "!=", "<", ">"}
+
+func ParseThreshold(expr string) (Threshold, error) {
+	for _, op := range thresholdOps {
+		idx := strings.Index(expr, op)
+		if idx < 0 {
+			continue
+		}
+
+		metric := strings.TrimSpace(expr[:idx])
+		raw := strings.TrimSpace(expr[idx+len(op):])
+		if metric == "" || raw == "" {
+			return Threshold{}, fmt.Errorf("invalid threshold %q", expr)
+		}
+
+		value, err := parseThresholdValue(raw)
+		if err != nil {
+			return Threshold{}, fmt.Errorf("invalid threshold %q: %v", expr, err)
+		}
+
+		return Threshold{Expr: expr, Metric: metric, Op: op, Value: value}, nil
+	}
+
+	return Threshold{}, fmt.Errorf("invalid threshold %q: expected <metric> <op> <value>", expr)
+}
+
+func parseThresholdValue(raw string) (float64, error) {
+	if strings.HasSuffix(raw, "%") {
+		v, err := strconv.ParseFloat(strings.TrimSuffix(raw, "%"), 64)
+		return v / 100, err
+	}
+
+	if v, err := strconv.ParseFloat(raw, 64); err == nil {
+		return v, nil
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%q is neither a number nor a duration", raw)
+	}
+	return float64(d) / float64(time.Millisecond), nil
+}
+
+func (t Threshold) Evaluate(r Result) ThresholdResult {
+	actual, ok := r.Metric(t.Metric)
+	res := ThresholdResult{Threshold: t.Expr, Actual: actual}
+	if !ok {
+		res.Error = fmt.Sprintf("unknown metric %q", t.Metric)
+		return res
+	}
+
+	switch t.Op {
+	case "<":
+		res.Passed = actual < t.Value
+	case "<=":
+		res.Passed = actual <= t.Value
+	case ">":
+		res.Passed = actual > t.Value
+	case ">=":
+		res.Passed = actual >= t.Value
+	case "==":
+		res.Passed = actual == t.Value
+	case "!=":
+		res.Passed = actual != t.Value
+	}
+	return res
+}
+
+// Metric resolves a threshold metric name against the result.
+func (r Result) Metric(name string) (float64, bool) {
+	switch name {
+	case "failure_rate":
+		total := r.Passed + r.Failed
+		if total == 0 {
+			return 0, true
+		}
+		return float64(r.Failed) / float64(total), true
+	case "passed":
+		return float64(r.Passed), true
+	case "failed":
+		return float64(r.Failed), true
+	case "dropped":
+		return float64(r.Dropped), true
+	case "sessions":
+		return float64(r.StopCount), true
+	case "connects":
+		return float64(r.Connects), true
+	case "bytes":
+		return float64(r.BytesReceived), true
+	case "messages":
+		return float64(r.MessagesReceived), true
+	case "stalls":
+		return float64(r.Failures[ReasonIdleTimeout]), true
+	case "rebuffer_ratio":
+		// Share of watch time spent stalled, from the player counters.
+		stalled, played := r.Counters[StalledMs], r.Counters[PlayedMs]
+		if stalled+played == 0 {
+			return 0, true
+		}
+		return float64(stalled) / float64(stalled+played), true
+	}
+
+	if count, ok := r.Counters[name]; ok {
+		return float64(count), true
+	}
+
+	group, field, found := strings.Cut(name, ".")
+	if !found {
+		return 0, false
+	}
+
+	if group == "failures" {
+		return float64(r.Failures[FailureReason(field)]), true
+	}
+
+	c, isValue := r.Values[group]
+	if group == "messages_per_connection" {
+		c, isValue = r.MessagesPerConnection, true
+	}
+	if isValue {
+		switch field {
+		case "count":
+			return float64(c.Count), true
+		case "min":
+			return float64(c.Min), true
+		case "p50":
+			return float64(c.P50), true
+		case "p90":
+			return float64(c.P90), true
+		case "p99":
+			return float64(c.P99), true
+		case "max":
+			return float64(c.Max), true
+		}
+		return 0, false
+	}
+
+	l, ok := r.Latency[group]
+	if !ok {
+		return 0, false
+	}
+	switch field {
+	case "count":
+		return float64(l.Count), true
+	case "p50":
+		return l.P50, true
+	case "p90":
+		return l.P90, true
+	case "p99":
+		return l.P99, true
+	case "p999":
+		return l.P999, true
+	case "max":
+		return l.Max, true
+	}
+	return 0, false
+}
@@ -0,0 +1,101 @@
+package core
+
+import "testing"
+
+func TestParseThreshold(t *testing.T) {
+	tests := []struct {
+		expr    string
+		metric  string
+		op      string
+		value   float64
+		invalid bool
+	}{
+		{expr: "connect_time.p99 < 500ms", metric: "connect_time.p99", op: "<", value: 500},
+		{expr: "connect_time.p99<=1.5s", metric: "connect_time.p99", op: "<=", value: 1500},
+		{expr: "rtt.max < 250us", metric: "rtt.max", op: "<", value: 0.25},
+		{expr: "failure_rate < 1%", metric: "failure_rate", op: "<", value: 0.01},
+		{expr: "failure_rate <= 0.05", metric: "failure_rate", op: "<=", value: 0.05},
+		{expr: "passed > 0", metric: "passed", op: ">", value: 0},
+		{expr: "messages >= 100", metric: "messages", op: ">=", value: 100},
+		{expr: "failures.protocol == 0", metric: "failures.protocol", op: "==", value: 0},
+		{expr: "dropped != 3", metric: "dropped", op: "!=", value: 3},
+		{expr: "failure_rate", invalid: true},
+		{expr: "< 5", invalid: true},
+		{expr: "passed >", invalid: true},
+		{expr: "passed > many", invalid: true},
+		{expr: "failure_rate < x%", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			th, err := ParseThreshold(tt.expr)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("parsed %+v, want an error", th)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if th.Metric != tt.metric || th.Op != tt.op || th.Value != tt.value {
+				t.Errorf("got %s %s %v, want %s %s %v", th.Metric, th.Op, th.Value, tt.metric, tt.op, tt.value)
+			}
+		})
+	}
+}
+
+func TestThresholdEvaluate(t *testing.T) {
+	r := Result{
+		Passed:   9,
+		Failed:   1,
+		Failures: map[FailureReason]int64{ReasonProtocol: 1},
+		Counters: map[string]int64{"reconnects": 4, StalledMs: 250, PlayedMs: 750},
+		Values:   map[string]CountSummary{"segment_kbps": {Count: 3, Min: 400, P50: 600}},
+		Latency:  map[string]LatencySummary{"connect_time": {Count: 10, P99: 120.5}},
+	}
+
+	tests := []struct {
+		expr    string
+		actual  float64
+		passed  bool
+		unknown bool
+	}{
+		{expr: "failure_rate < 5%", actual: 0.1, passed: false},
+		{expr: "failure_rate <= 10%", actual: 0.1, passed: true},
+		{expr: "failures.protocol == 1", actual: 1, passed: true},
+		{expr: "failures.server_close == 0", actual: 0, passed: true},
+		{expr: "reconnects > 3", actual: 4, passed: true},
+		{expr: "rebuffer_ratio < 20%", actual: 0.25, passed: false},
+		{expr: "segment_kbps.min >= 500", actual: 400, passed: false},
+		{expr: "segment_kbps.p50 >= 500", actual: 600, passed: true},
+		{expr: "connect_time.p99 < 100ms", actual: 120.5, passed: false},
+		{expr: "connect_time.count == 10", actual: 10, passed: true},
+		{expr: "messages_per_connection.p50 == 0", actual: 0, passed: true},
+		{expr: "missing > 0", unknown: true},
+		{expr: "connect_time.p75 < 1s", unknown: true},
+		{expr: "segment_kbps.p999 > 0", unknown: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			th, err := ParseThreshold(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := th.Evaluate(r)
+			if tt.unknown {
+				if res.Error == "" || res.Passed {
+					t.Errorf("result %+v, want an unknown metric error", res)
+				}
+				return
+			}
+			if res.Error != "" {
+				t.Fatal(res.Error)
+			}
+			if res.Actual != tt.actual || res.Passed != tt.passed {
+				t.Errorf("actual %v passed %v, want %v %v", res.Actual, res.Passed, tt.actual, tt.passed)
+			}
+		})
+	}
+}
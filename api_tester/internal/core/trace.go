@@ -0,0 +1,35 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// SessionTrace is the timeline of one session, handed to Options.Trace when
+// the session ends. Zero times mark phases the session never reached.
+type SessionTrace struct {
+	User      int64
+	TraceID   [16]byte
+	SpanID    [8]byte
+	Start     time.Time
+	Dialed    time.Time
+	Connected time.Time
+	FirstData time.Time
+	Closing   time.Time
+	End       time.Time
+	Messages  int64
+	Outcome   Outcome
+}
+
+func newTrace(user int64) *SessionTrace {
+	t := &SessionTrace{User: user}
+	rand.Read(t.TraceID[:])
+	rand.Read(t.SpanID[:])
+	return t
+}
+
+// Traceparent is the W3C trace context header value of the session span.
+func (t *SessionTrace) Traceparent() string {
+	return "00-" + hex.EncodeToString(t.TraceID[:]) + "-" + hex.EncodeToString(t.SpanID[:]) + "-01"
+}
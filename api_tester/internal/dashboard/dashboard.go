@@ -0,0 +1,192 @@
+package dashboard
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+)
+
+const (
+	ModeAuto  = "auto"
+	ModeTUI   = "tui"
+	ModePlain = "plain"
+	ModeOff   = "off"
+
+	refreshInterval = time.Second
+)
+
+// Dashboard periodically renders the live state of a run. On a terminal it
+// redraws a status block in place, otherwise it prints one line per refresh.
+// Latency percentiles come from the latest sample of the time series, so they
+// follow the run instead of settling on whole-run values.
+type Dashboard struct {
+	out      *os.File
+	tty      bool
+	snapshot func() core.Result
+	latest   func() (core.Sample, bool)
+	previous core.Result
+	drawn    int
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func ResolveMode(mode string, out *os.File) (string, error) {
+	switch mode {
+	case "", ModeAuto:
+		if IsTerminal(out) {
+			return ModeTUI, nil
+		}
+		return ModePlain, nil
+	case ModeTUI, ModePlain, ModeOff:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown progress mode: %s. Supported modes: auto, tui, plain, off", mode)
+	}
+}
+
+func IsTerminal(out *os.File) bool {
+	info, err := out.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func New(mode string, out *os.File, snapshot func() core.Result, latest func() (core.Sample, bool)) *Dashboard {
+	if mode == ModeOff {
+		return nil
+	}
+
+	return &Dashboard{
+		out:      out,
+		tty:      mode == ModeTUI,
+		snapshot: snapshot,
+		latest:   latest,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (d *Dashboard) Start() {
+	if d == nil {
+		return
+	}
+
+	go func() {
+		defer close(d.done)
+
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-d.stop:
+				d.render()
+				return
+			case <-ticker.C:
+				d.render()
+			}
+		}
+	}()
+}
+
+// Stop renders the final state and waits for the dashboard to exit.
+func (d *Dashboard) Stop() {
+	if d == nil {
+		return
+	}
+
+	close(d.stop)
+	<-d.done
+}
+
+func (d *Dashboard) render() {
+	current := d.snapshot()
+	seconds := current.Elapsed - d.previous.Elapsed
+	if seconds <= 0 {
+		seconds = refreshInterval.Seconds()
+	}
+
+	rate := func(now, before int64) float64 {
+		return float64(now-before) / seconds
+	}
+
+	connects := rate(current.Connects, d.previous.Connects)
+	bytes := rate(current.BytesReceived, d.previous.BytesReceived)
+	messages := rate(current.MessagesReceived, d.previous.MessagesReceived)
+	d.previous = current
+
+	status := "running"
+	if current.Interrupted {
+		status = "draining: " + current.InterruptReason
+	}
+
+	sample, _ := d.latest()
+	connect := sample.Latency[core.ConnectTime]
+	first := sample.Latency[core.FirstData]
+	gap := sample.Latency[core.InterArrival]
+
+	if !d.tty {
+		fmt.Fprintf(d.out, "[%6.1fs] active=%d connects/s=%.1f passed=%d failed=%d%s rx=%s/s msgs/s=%.1f connect_p99=%s first_data_p99=%s\n",
+			current.Elapsed, current.Active, connects, current.Passed, current.Failed, failures(current),
+			formatBytes(bytes), messages, formatMs(connect.Count, connect.P99), formatMs(first.Count, first.P99))
+		return
+	}
+
+	lines := []string{
+		fmt.Sprintf(" %s  elapsed %.0fs", status, current.Elapsed),
+		fmt.Sprintf(" active %-8d connects/s %-8.1f dropped %d", current.Active, connects, current.Dropped),
+		fmt.Sprintf(" passed %-8d failed %d%s", current.Passed, current.Failed, failures(current)),
+		fmt.Sprintf(" rx %-12s msgs/s %.1f", formatBytes(bytes)+"/s", messages),
+		" latency over the last sample_interval",
+		fmt.Sprintf(" connect       p50 %10s  p99 %10s", formatMs(connect.Count, connect.P50), formatMs(connect.Count, connect.P99)),
+		fmt.Sprintf(" first data    p50 %10s  p99 %10s", formatMs(first.Count, first.P50), formatMs(first.Count, first.P99)),
+		fmt.Sprintf(" inter-arrival p50 %10s  p99 %10s", formatMs(gap.Count, gap.P50), formatMs(gap.Count, gap.P99)),
+	}
+
+	var b strings.Builder
+	if d.drawn > 0 {
+		fmt.Fprintf(&b, "\033[%dA\033[J", d.drawn)
+	}
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	fmt.Fprint(d.out, b.String())
+	d.drawn = len(lines)
+}
+
+func failures(r core.Result) string {
+	if len(r.Failures) == 0 {
+		return ""
+	}
+
+	reasons := make([]string, 0, len(r.Failures))
+	for reason, count := range r.Failures {
+		reasons = append(reasons, fmt.Sprintf("%s %d", reason, count))
+	}
+	sort.Strings(reasons)
+	return " (" + strings.Join(reasons, ", ") + ")"
+}
+
+// formatMs prints a latency in milliseconds, or "-" for a window without samples.
+func formatMs(count int64, ms float64) string {
+	if count == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fms", ms)
+}
+
+func formatBytes(b float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	i := 0
+	for b >= 1024 && i < len(units)-1 {
+		b /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", b, units[i])
+}
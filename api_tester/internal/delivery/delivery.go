@@ -0,0 +1,175 @@
+package delivery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+	"github.com/belalakhter/packages/api_tester/internal/match"
+)
+
+const (
+	Latency   = "delivery_latency"
+	Skew      = "delivery_skew"
+	ClockSkew = "clock_skew"
+	Unstamped = "unstamped_messages"
+)
+
+// Config locates the publish timestamp a server embeds in its messages, either
+// at a JSON path or in the first capture group of a regex on the raw message.
+// Unit is s, ms, us, ns or rfc3339; by default numbers are classified by
+// magnitude and strings parsed as RFC 3339.
+type Config struct {
+	JSON  string `yaml:"json"`
+	Regex string `yaml:"regex"`
+	Unit  string `yaml:"unit"`
+}
+
+// Clock turns embedded timestamps into delivery latency.
+type Clock struct {
+	path  []string
+	regex *regexp.Regexp
+	unit  string
+}
+
+func (c *Config) Compile() (*Clock, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	clock := &Clock{unit: c.Unit}
+	switch {
+	case c.JSON != "" && c.Regex != "":
+		return nil, fmt.Errorf("delivery needs json or regex, not both")
+	case c.JSON != "":
+		path, err := match.ParsePath(c.JSON)
+		if err != nil {
+			return nil, fmt.Errorf("delivery: %v", err)
+		}
+		clock.path = path
+	case c.Regex != "":
+		re, err := regexp.Compile(c.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("delivery: invalid regex %q: %v", c.Regex, err)
+		}
+		if re.NumSubexp() < 1 {
+			return nil, fmt.Errorf("delivery: regex %q needs a capture group", c.Regex)
+		}
+		clock.regex = re
+	default:
+		return nil, fmt.Errorf("delivery needs json or regex")
+	}
+
+	switch c.Unit {
+	case "", "s", "ms", "us", "ns", "rfc3339":
+	default:
+		return nil, fmt.Errorf("unknown delivery unit: %s. Supported units: s, ms, us, ns, rfc3339", c.Unit)
+	}
+	return clock, nil
+}
+
+// Init is called once per session, before the first Observe.
+func (c *Clock) Init(m *core.Meter) {
+	m.Register(ClockSkew, Unstamped)
+}
+
+// Observe records the delivery latency of a message received now. A
+// timestamp ahead of the local clock cannot be a real latency: it is counted
+// as clock_skew and its lead recorded as delivery_skew instead.
+func (c *Clock) Observe(msg []byte, m *core.Meter) {
+	received := time.Now()
+
+	sent, ok := c.timestamp(msg)
+	if !ok {
+		m.Count(Unstamped, 1)
+		return
+	}
+
+	lag := received.Sub(sent)
+	if lag < 0 {
+		m.Count(ClockSkew, 1)
+		m.Observe(Skew, -lag)
+		return
+	}
+	m.Observe(Latency, lag)
+}
+
+func (c *Clock) timestamp(msg []byte) (time.Time, bool) {
+	var raw string
+	if c.regex != nil {
+		sub := c.regex.FindSubmatch(msg)
+		if sub == nil {
+			return time.Time{}, false
+		}
+		raw = string(sub[1])
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(msg))
+		dec.UseNumber()
+		var doc interface{}
+		if err := dec.Decode(&doc); err != nil {
+			return time.Time{}, false
+		}
+		value, ok := match.Lookup(doc, c.path)
+		if !ok {
+			return time.Time{}, false
+		}
+		raw = match.String(value)
+	}
+	return c.parse(raw)
+}
+
+func (c *Clock) parse(raw string) (time.Time, bool) {
+	if c.unit == "rfc3339" {
+		t, err := time.Parse(time.RFC3339Nano, raw)
+		return t, err == nil
+	}
+
+	n, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		if c.unit != "" {
+			return time.Time{}, false
+		}
+		t, err := time.Parse(time.RFC3339Nano, raw)
+		return t, err == nil
+	}
+
+	unit := c.unit
+	if unit == "" {
+		unit = guessUnit(n)
+	}
+
+	// Nanosecond timestamps exceed float64 precision, so parse them exactly when possible.
+	if unit == "ns" {
+		if i, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			return time.Unix(0, i), true
+		}
+	}
+
+	ns := n * unitScale[unit]
+	if math.Abs(ns) >= math.MaxInt64 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(ns)), true
+}
+
+var unitScale = map[string]float64{"s": 1e9, "ms": 1e6, "us": 1e3, "ns": 1}
+
+// guessUnit classifies a unix timestamp by magnitude: any date between 1973
+// and 5138 has a distinct number of digits in each unit.
+func guessUnit(n float64) string {
+	switch {
+	case n < 1e11:
+		return "s"
+	case n < 1e14:
+		return "ms"
+	case n < 1e17:
+		return "us"
+	default:
+		return "ns"
+	}
+}
@@ -0,0 +1,118 @@
+package flv
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/utils/pio"
+)
+
+const (
+	PreviousTagSizeErrors = "previous_tag_size_errors"
+
+	fileHeaderLen = 9
+	tagHeaderLen  = 11
+	tagSizeLen    = 4
+)
+
+type tag struct {
+	kind      uint8
+	timestamp uint32
+	data      []byte
+}
+
+// demuxer splits an FLV stream into tags. The data of a tag is only valid
+// until the next one is read.
+type demuxer struct {
+	r      *bufio.Reader
+	m      *core.Meter
+	header [tagHeaderLen]byte
+	data   []byte
+}
+
+func newDemuxer(r io.Reader, m *core.Meter) *demuxer {
+	return &demuxer{r: bufio.NewReaderSize(r, 64*1024), m: m}
+}
+
+// readHeader validates the FLV header and the PreviousTagSize0 after it.
+func (d *demuxer) readHeader() error {
+	b := d.header[:fileHeaderLen]
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return truncated(err)
+	}
+	if string(b[:3]) != "FLV" {
+		return protocolError("not an flv stream: signature %q", b[:3])
+	}
+	if b[3] != 1 {
+		return protocolError("unsupported flv version %d", b[3])
+	}
+
+	offset := pio.U32BE(b[5:9])
+	if offset < fileHeaderLen {
+		return protocolError("invalid flv header size %d", offset)
+	}
+	if _, err := d.r.Discard(int(offset - fileHeaderLen)); err != nil {
+		return truncated(err)
+	}
+
+	size := d.header[:tagSizeLen]
+	if _, err := io.ReadFull(d.r, size); err != nil {
+		return truncated(err)
+	}
+	if pio.U32BE(size) != 0 {
+		d.m.Count(PreviousTagSizeErrors, 1)
+	}
+	return nil
+}
+
+// next reads the next tag and checks the PreviousTagSize that follows it. A
+// wrong size is only counted, but a tag of unknown type means the stream is
+// out of sync and fails the session.
+func (d *demuxer) next() (tag, error) {
+	h := d.header[:]
+	if _, err := io.ReadFull(d.r, h); err != nil {
+		return tag{}, truncated(err)
+	}
+
+	t := tag{
+		kind:      h[0] & 0x1f,
+		timestamp: pio.U24BE(h[4:7]) | uint32(h[7])<<24,
+	}
+	switch t.kind {
+	case av.TAG_AUDIO, av.TAG_VIDEO, av.TAG_SCRIPTDATAAMF0:
+	default:
+		return tag{}, protocolError("unknown flv tag type %d", t.kind)
+	}
+
+	size := int(pio.U24BE(h[1:4]))
+	if cap(d.data) < size+tagSizeLen {
+		d.data = make([]byte, size+tagSizeLen)
+	}
+	data := d.data[:size+tagSizeLen]
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return tag{}, truncated(err)
+	}
+	if pio.U32BE(data[size:]) != uint32(tagHeaderLen+size) {
+		d.m.Count(PreviousTagSizeErrors, 1)
+	}
+
+	t.data = data[:size]
+	return t, nil
+}
+
+// truncated turns a stream that ends inside the header or a tag into a
+// server close; io.EOF between tags is the regular end of the stream.
+func truncated(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return core.Error(core.Fail(core.ReasonServerClose, errors.New("flv stream ended inside a tag")))
+	}
+	return err
+}
+
+func protocolError(format string, args ...interface{}) error {
+	return core.Error(core.Fail(core.ReasonProtocol, fmt.Errorf(format, args...)))
+}
@@ -0,0 +1,88 @@
+package flv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+	"github.com/gwuhaolin/livego/av"
+)
+
+var fileHeader = []byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 9, 0, 0, 0, 0}
+
+// flvTag encodes a tag followed by its PreviousTagSize, adding skew to the size.
+func flvTag(kind uint8, timestamp uint32, data []byte, skew int) []byte {
+	size := len(data)
+	b := []byte{kind, byte(size >> 16), byte(size >> 8), byte(size),
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(timestamp >> 24), 0, 0, 0}
+	b = append(b, data...)
+	prev := uint32(tagHeaderLen + size + skew)
+	return append(b, byte(prev>>24), byte(prev>>16), byte(prev>>8), byte(prev))
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestDemuxer(t *testing.T) {
+	video := flvTag(av.TAG_VIDEO, 40, []byte{0x17, 1, 0, 0, 0}, 0)
+	audio := flvTag(av.TAG_AUDIO, 0x01000020, []byte{0xaf, 1, 0x21}, 0)
+
+	tests := []struct {
+		name      string
+		stream    []byte
+		tags      int
+		sizeErrs  int64
+		reason    core.FailureReason
+		timestamp uint32
+	}{
+		{name: "tags", stream: join(fileHeader, video, audio), tags: 2, timestamp: 0x01000020},
+		{name: "header only", stream: fileHeader},
+		{name: "extended header", stream: join([]byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 12, 1, 2, 3, 0, 0, 0, 0}, video), tags: 1, timestamp: 40},
+		{name: "nonzero first size", stream: join(fileHeader[:9], []byte{0, 0, 0, 7}, video), tags: 1, sizeErrs: 1, timestamp: 40},
+		{name: "wrong tag size", stream: join(fileHeader, flvTag(av.TAG_VIDEO, 40, []byte{0x27, 1, 0, 0, 0}, 3), audio), tags: 2, sizeErrs: 1, timestamp: 0x01000020},
+		{name: "bad signature", stream: []byte("HTTP/1.1 200 OK\r\n\r\n"), reason: core.ReasonProtocol},
+		{name: "bad version", stream: join([]byte{'F', 'L', 'V', 2}, fileHeader[4:]), reason: core.ReasonProtocol},
+		{name: "short header size", stream: join([]byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 4}, fileHeader[9:]), reason: core.ReasonProtocol},
+		{name: "unknown tag type", stream: join(fileHeader, video, flvTag(7, 80, []byte{1}, 0)), tags: 1, reason: core.ReasonProtocol, timestamp: 40},
+		{name: "truncated header", stream: fileHeader[:6], reason: core.ReasonServerClose},
+		{name: "truncated tag", stream: join(fileHeader, video, audio[:8]), tags: 1, reason: core.ReasonServerClose, timestamp: 40},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := core.NewStats()
+			d := newDemuxer(bytes.NewReader(tt.stream), core.NewMeter(stats))
+
+			var tags int
+			var timestamp uint32
+			err := d.readHeader()
+			for err == nil {
+				var next tag
+				if next, err = d.next(); err == nil {
+					tags++
+					timestamp = next.timestamp
+				}
+			}
+
+			var f *core.Failure
+			switch {
+			case tt.reason == "" && err != io.EOF:
+				t.Errorf("err = %v, want io.EOF", err)
+			case tt.reason != "" && (!errors.As(err, &f) || f.Outcome.Reason != tt.reason):
+				t.Errorf("err = %v, want a %s failure", err, tt.reason)
+			}
+			if tags != tt.tags {
+				t.Errorf("tags = %d, want %d", tags, tt.tags)
+			}
+			if timestamp != tt.timestamp {
+				t.Errorf("last timestamp = %#x, want %#x", timestamp, tt.timestamp)
+			}
+			if n := stats.Counters()[PreviousTagSizeErrors]; n != tt.sizeErrs {
+				t.Errorf("%s = %d, want %d", PreviousTagSizeErrors, n, tt.sizeErrs)
+			}
+		})
+	}
+}
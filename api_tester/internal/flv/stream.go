@@ -0,0 +1,378 @@
+package flv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/gwuhaolin/livego/utils/pio"
+)
+
+const (
+	VideoFrames        = "video_frames"
+	AudioFrames        = "audio_frames"
+	Keyframes          = "keyframes"
+	KeyframeInterval   = "keyframe_interval"
+	TagErrors          = "tag_errors"
+	Metadata           = "metadata"
+	MetadataMismatches = "metadata_mismatches"
+	VideoCodec         = "video_codec"
+	VideoResolution    = "video_resolution"
+	AudioCodec         = "audio_codec"
+	AudioSampleRate    = "audio_sample_rate"
+	AudioChannels      = "audio_channels"
+
+	// soundFormatEx and the top bit of a video tag mark the enhanced RTMP
+	// headers, which name the codec with a FourCC.
+	soundFormatEx = 9
+	videoHeaderEx = 0x80
+	frameCommand  = 5
+)
+
+var videoCodecs = map[uint8]string{2: "h263", 3: "screen", 4: "vp6", 5: "vp6a", 6: "screen2", 7: "h264", 12: "h265"}
+
+var audioCodecs = map[uint8]string{0: "pcm", 1: "adpcm", 2: "mp3", 3: "pcm", 4: "nellymoser", 5: "nellymoser", 6: "nellymoser",
+	7: "g711a", 8: "g711u", 10: "aac", 11: "speex", 14: "mp3"}
+
+var fourCCs = map[string]string{"avc1": "h264", "hvc1": "h265", "av01": "av1", "vp09": "vp9",
+	"mp4a": "aac", "Opus": "opus", "fLaC": "flac", "ac-3": "ac3", "ec-3": "eac3", ".mp3": "mp3"}
+
+var soundRates = [4]int{5512, 11025, 22050, 44100}
+
+// stream checks the tags of one FLV session. Codec details are counted once
+// per session under the group they belong to, video_codec.h264 for example,
+// and again whenever a new sequence header changes them.
+type stream struct {
+	m      *core.Meter
+	frames atomic.Int64
+
+	lastKeyframe uint32
+	keyframes    int
+
+	video       string
+	videoConfig []byte
+	width       int
+	height      int
+
+	audio       string
+	audioConfig []byte
+	sampleRate  int
+	channels    int
+
+	meta *metadata
+}
+
+// metadata holds the stream properties announced by onMetaData.
+type metadata struct {
+	video  string
+	audio  string
+	width  int
+	height int
+}
+
+func newStream(m *core.Meter) *stream {
+	m.Register(VideoFrames, AudioFrames, Keyframes, TagErrors, PreviousTagSizeErrors, MetadataMismatches)
+	return &stream{m: m}
+}
+
+// read demuxes r until the stream ends or breaks. Every tag counts as a message.
+func (s *stream) read(r io.Reader) error {
+	d := newDemuxer(r, s.m)
+	if err := d.readHeader(); err != nil {
+		return err
+	}
+	for {
+		t, err := d.next()
+		if err != nil {
+			return err
+		}
+		s.m.Data(tagHeaderLen + len(t.data) + tagSizeLen)
+
+		switch t.kind {
+		case av.TAG_VIDEO:
+			s.videoTag(t)
+		case av.TAG_AUDIO:
+			s.audioTag(t)
+		case av.TAG_SCRIPTDATAAMF0:
+			s.scriptTag(t)
+		}
+	}
+}
+
+func (s *stream) videoTag(t tag) {
+	if len(t.data) < 1 {
+		s.m.Count(TagErrors, 1)
+		return
+	}
+
+	flags := t.data[0]
+	var codec string
+	var frameType uint8
+	var header, frame bool
+	var config []byte
+	if flags&videoHeaderEx != 0 {
+		frameType = flags >> 4 & 0x7
+		packetType := flags & 0xf
+		if len(t.data) < 5 {
+			s.m.Count(TagErrors, 1)
+			return
+		}
+		codec = fourCC(t.data[1:5])
+		switch packetType {
+		case 0:
+			header, config = true, t.data[5:]
+		case 1, 3, 6:
+			frame = true
+		}
+	} else {
+		frameType = flags >> 4
+		codecID := flags & 0xf
+		codec = videoCodecs[codecID]
+		if codec == "" {
+			codec = fmt.Sprintf("codec%d", codecID)
+		}
+		frame = true
+		if codecID == av.VIDEO_H264 || codecID == 12 {
+			if len(t.data) < 5 {
+				s.m.Count(TagErrors, 1)
+				return
+			}
+			switch t.data[1] {
+			case av.AVC_SEQHDR:
+				header, config, frame = true, t.data[5:], false
+			case 2:
+				frame = false
+			}
+		}
+	}
+	if frameType == frameCommand {
+		return
+	}
+
+	s.setVideoCodec(codec)
+	if header {
+		s.videoHeader(codec, config)
+	}
+	if !frame {
+		return
+	}
+
+	s.m.Count(VideoFrames, 1)
+	s.frames.Add(1)
+	if frameType == av.FRAME_KEY {
+		s.m.Count(Keyframes, 1)
+		// Tag timestamps are in media time, so the interval is the GOP duration.
+		if s.keyframes > 0 {
+			s.m.Observe(KeyframeInterval, time.Duration(int32(t.timestamp-s.lastKeyframe))*time.Millisecond)
+		}
+		s.lastKeyframe = t.timestamp
+		s.keyframes++
+	}
+}
+
+func (s *stream) setVideoCodec(codec string) {
+	if codec != "" && codec != s.video {
+		s.video = codec
+		s.m.Count(VideoCodec+"."+codec, 1)
+	}
+}
+
+// videoHeader reads the resolution from the SPS of an AVC sequence header.
+func (s *stream) videoHeader(codec string, config []byte) {
+	if bytes.Equal(config, s.videoConfig) {
+		return
+	}
+	s.videoConfig = append(s.videoConfig[:0], config...)
+	if codec != "h264" {
+		return
+	}
+
+	sps, ok := avcSPS(config)
+	if !ok {
+		s.m.Count(TagErrors, 1)
+		return
+	}
+	var parsed h264.SPS
+	if err := parsed.Unmarshal(sps); err != nil {
+		s.m.Count(TagErrors, 1)
+		return
+	}
+	if w, h := parsed.Width(), parsed.Height(); w != s.width || h != s.height {
+		s.width, s.height = w, h
+		s.m.Count(fmt.Sprintf("%s.%dx%d", VideoResolution, w, h), 1)
+	}
+}
+
+// avcSPS returns the first SPS of an AVCDecoderConfigurationRecord.
+func avcSPS(config []byte) ([]byte, bool) {
+	if len(config) < 8 || config[5]&0x1f == 0 {
+		return nil, false
+	}
+	n := int(pio.U16BE(config[6:8]))
+	if len(config) < 8+n {
+		return nil, false
+	}
+	return config[8 : 8+n], true
+}
+
+func (s *stream) audioTag(t tag) {
+	if len(t.data) < 1 {
+		s.m.Count(TagErrors, 1)
+		return
+	}
+
+	flags := t.data[0]
+	format := flags >> 4
+	switch format {
+	case soundFormatEx:
+		if len(t.data) < 5 {
+			s.m.Count(TagErrors, 1)
+			return
+		}
+		s.setAudioCodec(fourCC(t.data[1:5]))
+		switch flags & 0xf {
+		case 1, 5:
+		default:
+			return
+		}
+	case av.SOUND_AAC:
+		if len(t.data) < 2 {
+			s.m.Count(TagErrors, 1)
+			return
+		}
+		s.setAudioCodec("aac")
+		if t.data[1] == av.AAC_SEQHDR {
+			s.audioHeader(t.data[2:])
+			return
+		}
+	default:
+		codec := audioCodecs[format]
+		if codec == "" {
+			codec = fmt.Sprintf("format%d", format)
+		}
+		s.setAudioCodec(codec)
+		// Without a sequence header the tag flags carry the sample rate and channels.
+		s.setAudioFormat(soundRates[flags>>2&0x3], int(flags&0x1)+1)
+	}
+
+	s.m.Count(AudioFrames, 1)
+	s.frames.Add(1)
+}
+
+func (s *stream) setAudioCodec(codec string) {
+	if codec != "" && codec != s.audio {
+		s.audio = codec
+		s.m.Count(AudioCodec+"."+codec, 1)
+	}
+}
+
+// audioHeader reads the sample rate and channels from an AAC AudioSpecificConfig.
+func (s *stream) audioHeader(config []byte) {
+	if bytes.Equal(config, s.audioConfig) {
+		return
+	}
+	s.audioConfig = append(s.audioConfig[:0], config...)
+
+	var asc mpeg4audio.AudioSpecificConfig
+	if err := asc.Unmarshal(config); err != nil {
+		s.m.Count(TagErrors, 1)
+		return
+	}
+	s.setAudioFormat(asc.SampleRate, asc.ChannelCount)
+}
+
+func (s *stream) setAudioFormat(rate, channels int) {
+	if rate != s.sampleRate {
+		s.sampleRate = rate
+		s.m.Count(fmt.Sprintf("%s.%d", AudioSampleRate, rate), 1)
+	}
+	if channels != s.channels {
+		s.channels = channels
+		s.m.Count(fmt.Sprintf("%s.%d", AudioChannels, channels), 1)
+	}
+}
+
+// scriptTag decodes onMetaData, which may be wrapped in @setDataFrame.
+// Other script data such as cue points is ignored.
+func (s *stream) scriptTag(t tag) {
+	r := bytes.NewReader(t.data)
+	dec := amf.NewDecoder()
+	name, err := dec.DecodeAmf0(r)
+	if err == nil && name == amf.SetDataFrame {
+		name, err = dec.DecodeAmf0(r)
+	}
+	if err != nil {
+		s.m.Count(TagErrors, 1)
+		return
+	}
+	if name != amf.OnMetaData {
+		return
+	}
+
+	value, err := dec.DecodeAmf0(r)
+	if err != nil {
+		s.m.Count(TagErrors, 1)
+		return
+	}
+	obj, ok := value.(amf.Object)
+	if !ok {
+		s.m.Count(TagErrors, 1)
+		return
+	}
+
+	s.m.Count(Metadata, 1)
+	s.meta = &metadata{
+		video:  metaCodec(obj["videocodecid"], videoCodecs),
+		audio:  metaCodec(obj["audiocodecid"], audioCodecs),
+		width:  metaInt(obj["width"]),
+		height: metaInt(obj["height"]),
+	}
+}
+
+// finish compares the last onMetaData with the stream that was received,
+// counting one metadata_mismatches per session where they disagree.
+func (s *stream) finish() {
+	meta := s.meta
+	if meta == nil {
+		return
+	}
+
+	mismatch := meta.video != "" && s.video != "" && meta.video != s.video ||
+		meta.audio != "" && s.audio != "" && meta.audio != s.audio ||
+		meta.width > 0 && s.width > 0 && (meta.width != s.width || meta.height != s.height)
+	if mismatch {
+		s.m.Count(MetadataMismatches, 1)
+	}
+}
+
+// metaCodec names a codec given by id, or by FourCC in enhanced RTMP.
+func metaCodec(v interface{}, ids map[uint8]string) string {
+	switch v := v.(type) {
+	case float64:
+		return ids[uint8(v)]
+	case string:
+		return fourCC([]byte(v))
+	}
+	return ""
+}
+
+func metaInt(v interface{}) int {
+	if f, ok := v.(float64); ok {
+		return int(f)
+	}
+	return 0
+}
+
+func fourCC(b []byte) string {
+	if name, ok := fourCCs[string(b)]; ok {
+		return name
+	}
+	return ""
+}
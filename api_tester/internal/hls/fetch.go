@@ -0,0 +1,580 @@
+package hls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+	"github.com/bluenviron/gohlslib/pkg/playlist"
+)
+
+const (
+	PlaylistTime           = "playlist_time"
+	PlaylistUpdateInterval = "playlist_update_interval"
+	PlaylistReloads        = "playlist_reloads"
+	PlaylistErrors         = "playlist_errors"
+	StalePlaylists         = "stale_playlists"
+	SegmentTime            = "segment_time"
+	SegmentDownloadMs      = "segment_download_ms"
+	SegmentErrors          = "segment_errors"
+	MissingSegments        = "missing_segments"
+	SkippedSegments        = "skipped_segments"
+	SlowSegments           = "slow_segments"
+	SegmentKbps            = "segment_kbps"
+	PartTime               = "part_time"
+	Parts                  = "parts"
+	PreloadHints           = "preload_hints"
+	PreloadHintErrors      = "preload_hint_errors"
+	BlockingReloads        = "blocking_reloads"
+	LiveLatency            = "live_latency"
+
+	// liveEdgeSegments is how far behind the end of a live playlist playback
+	// starts, the minimum distance the HLS spec allows.
+	liveEdgeSegments = 3
+	// staleFactor is how many target durations a live playlist may go without
+	// a new segment before it counts as stale.
+	staleFactor = 1.5
+
+	maxPlaylistErrors = 3
+	maxSegmentErrors  = 3
+	maxPlaylistSize   = 4 << 20
+	minSegmentTimeout = time.Second * 10
+)
+
+// viewer loads playlists and segments itself instead of decoding the stream:
+// a reloader keeps the media playlist fresh and queues new segments, and a
+// downloader fetches them one at a time like a player does.
+type viewer struct {
+	id       int64
+	addr     string
+	client   *http.Client
+	mediaURL *url.URL
+	media    *playlist.Media
+	queue    *queue
+	player   *player
+	next     int
+	nextPart int
+	partTime time.Duration
+	listed   int
+	loaded   time.Time
+	updated  time.Time
+	changed  bool
+	stale    bool
+	rangeURL string
+	rangeEnd uint64
+	segments atomic.Int64
+
+	lowLatency bool
+
+	variantSettings
+	variants []variant
+	current  int
+	wanted   atomic.Int64
+	switchCh chan struct{}
+	abr      *abr
+	lastInit string
+}
+
+type segment struct {
+	seq       int
+	part      int
+	offset    time.Duration
+	partial   bool
+	hint      bool
+	end       time.Time
+	url       string
+	init      string
+	variant   string
+	duration  time.Duration
+	byteRange string
+}
+
+func newViewer(p *Protocol, id int64) *viewer {
+	// Every viewer keeps its own connections, as separate players would.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	v := &viewer{
+		id:              id,
+		addr:            p.addr,
+		client:          &http.Client{Transport: transport},
+		queue:           newQueue(),
+		player:          newPlayer(p.player),
+		variantSettings: p.variant,
+		switchCh:        make(chan struct{}, 1),
+		lowLatency:      p.lowLatency,
+	}
+	if p.variant.strategy == "abr" {
+		v.abr = &abr{}
+	}
+	return v
+}
+
+// Dial loads the playlist at addr and, for a multivariant playlist, the
+// media playlist of the variant the strategy chooses.
+func (v *viewer) Dial(ctx context.Context, m *core.Meter) error {
+	v.player.open(time.Now())
+	m.Register(PlaylistReloads, PlaylistErrors, StalePlaylists, SegmentErrors, MissingSegments, SkippedSegments, SlowSegments,
+		Rebuffers, core.StalledMs, core.PlayedMs)
+
+	var dialed sync.Once
+	traced := httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			dialed.Do(m.Dialed)
+		},
+	})
+
+	u, err := url.Parse(v.addr)
+	if err != nil {
+		return core.Error(core.Fail(core.ReasonClient, err))
+	}
+	pl, err := v.loadPlaylist(traced, u, m)
+	if err != nil {
+		return err
+	}
+
+	if master, ok := pl.(*playlist.Multivariant); ok {
+		if len(master.Variants) == 0 {
+			return core.Error(core.Fail(core.ReasonProtocol, errors.New("multivariant playlist has no variants")))
+		}
+		if v.variants, err = variants(master, u); err != nil {
+			return core.Error(core.Fail(core.ReasonProtocol, err))
+		}
+		if v.current, err = v.choose(v.variants, v.id); err != nil {
+			return core.Error(core.Fail(core.ReasonClient, err))
+		}
+		v.wanted.Store(int64(v.current))
+
+		m.Register(VariantSwitches)
+		for _, vr := range v.variants {
+			m.Register(VariantSegments+"."+vr.name, VariantBytes+"."+vr.name, VariantErrors+"."+vr.name)
+		}
+
+		u = v.variants[v.current].url
+		if pl, err = v.loadPlaylist(ctx, u, m); err != nil {
+			return err
+		}
+	}
+
+	media, ok := pl.(*playlist.Media)
+	if !ok {
+		return core.Error(core.Fail(core.ReasonProtocol, fmt.Errorf("%s is not a media playlist", u)))
+	}
+
+	v.mediaURL = u
+	v.loaded, v.updated = time.Now(), time.Now()
+	v.update(media, m)
+	return nil
+}
+
+// Run downloads segments until the playlist ends and plays them out, or
+// until ctx is done. Live playlists are reloaded alongside the downloads.
+func (v *viewer) Run(ctx context.Context, m *core.Meter) error {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer v.player.settle(m)
+
+	downloadErr := make(chan error, 1)
+	go func() {
+		downloadErr <- v.download(runCtx, m)
+	}()
+
+	reloadErr := make(chan error, 1)
+	go func() {
+		reloadErr <- v.reload(runCtx, m)
+	}()
+
+	ticker := time.NewTicker(playerTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return v.ended()
+
+		case err := <-reloadErr:
+			if err != nil {
+				return v.finish(ctx, err)
+			}
+			reloadErr = nil
+
+		case err := <-downloadErr:
+			if err != nil || ctx.Err() != nil {
+				return v.finish(ctx, err)
+			}
+			v.player.end(m)
+			downloadErr = nil
+
+		case <-ticker.C:
+			done, err := v.player.check(m)
+			if err != nil || done {
+				return v.finish(ctx, err)
+			}
+		}
+	}
+}
+
+func (v *viewer) finish(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return v.ended()
+	}
+	if err != nil {
+		return err
+	}
+	if v.segments.Load() == 0 {
+		return core.Error(core.Fail(core.ReasonServerClose, errors.New("playlist ended before any segment")))
+	}
+	return nil
+}
+
+// ended is the result of a session whose time ran out: it passes once a
+// segment was downloaded, like the decode mode once data arrived.
+func (v *viewer) ended() error {
+	if v.segments.Load() == 0 {
+		return core.Error(core.Fail(core.ReasonIdleTimeout, errors.New("no segment downloaded")))
+	}
+	return nil
+}
+
+func (v *viewer) Close() error {
+	v.client.CloseIdleConnections()
+	return nil
+}
+
+// reload refreshes a live media playlist as the HLS spec asks of clients:
+// one target duration after a load that brought new segments, half of it
+// after one that did not. It also carries out variant switches, which are
+// the only work left once the playlist has ended.
+func (v *viewer) reload(ctx context.Context, m *core.Meter) error {
+	failures := 0
+	for {
+		var timer *time.Timer
+		var due <-chan time.Time
+		if !v.media.Endlist {
+			delay := time.Duration(v.media.TargetDuration) * time.Second
+			switch {
+			case v.blocking():
+				delay = 0
+			case !v.changed:
+				delay /= 2
+			}
+			timer = time.NewTimer(time.Until(v.loaded.Add(delay)))
+			due = timer.C
+		}
+
+		var err error
+		select {
+		case <-ctx.Done():
+		case <-due:
+			err = v.refresh(ctx, m)
+		case <-v.switchCh:
+			err = v.switchVariant(ctx, m)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err != nil {
+			m.Count(PlaylistErrors, 1)
+			if failures++; failures >= maxPlaylistErrors {
+				return err
+			}
+			continue
+		}
+		failures = 0
+	}
+}
+
+func (v *viewer) refresh(ctx context.Context, m *core.Meter) error {
+	u := v.mediaURL
+	if v.blocking() {
+		// Ask for the playlist that lists the next part; the server holds the
+		// request until it exists, for at most three target durations.
+		query := u.Query()
+		query.Set("_HLS_msn", strconv.Itoa(v.next))
+		query.Set("_HLS_part", strconv.Itoa(v.listed))
+		blocked := *u
+		blocked.RawQuery = query.Encode()
+		u = &blocked
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 3*time.Duration(v.media.TargetDuration)*time.Second)
+		defer cancel()
+		m.Count(BlockingReloads, 1)
+	}
+
+	start := time.Now()
+	media, err := v.loadMedia(ctx, u, m)
+	m.Count(PlaylistReloads, 1)
+	v.loaded = start
+	if err != nil {
+		return err
+	}
+
+	v.changed = v.update(media, m)
+	target := time.Duration(media.TargetDuration) * time.Second
+	switch {
+	case v.changed:
+		m.Observe(PlaylistUpdateInterval, start.Sub(v.updated))
+		v.updated, v.stale = start, false
+	case !v.stale && start.Sub(v.updated) > time.Duration(staleFactor*float64(target)):
+		m.Count(StalePlaylists, 1)
+		v.stale = true
+	}
+	return nil
+}
+
+// switchVariant moves playback to the variant ABR asked for. Segments still
+// queued from the old variant are replaced by the same media sequence
+// numbers of the new one.
+func (v *viewer) switchVariant(ctx context.Context, m *core.Meter) error {
+	wanted := int(v.wanted.Load())
+	if wanted == v.current {
+		return nil
+	}
+
+	start := time.Now()
+	target := v.variants[wanted]
+	media, err := v.loadMedia(ctx, target.url, m)
+	if err != nil {
+		return err
+	}
+
+	m.Count(VariantSwitches, 1)
+	v.current, v.mediaURL, v.rangeURL = wanted, target.url, ""
+	v.loaded, v.updated, v.stale, v.changed = start, start, false, true
+
+	v.queue.replace(func(first segment, queued bool) []segment {
+		if queued {
+			v.next, v.nextPart, v.partTime = first.seq, 0, 0
+			if first.partial {
+				v.nextPart, v.partTime = first.part, first.offset
+			}
+		}
+		return v.collect(media, m)
+	})
+	v.media = media
+	if media.Endlist {
+		v.queue.end()
+	}
+	return nil
+}
+
+// blocking reports whether playlist reloads use LL-HLS blocking requests.
+func (v *viewer) blocking() bool {
+	media := v.media
+	return v.lowLatency && media.PartInf != nil && media.ServerControl != nil && media.ServerControl.CanBlockReload
+}
+
+// download fetches queued segments in order. A player skips a segment it
+// cannot load, so single failures are only counted; a run of them fails the session.
+func (v *viewer) download(ctx context.Context, m *core.Meter) error {
+	failures := 0
+	for {
+		if !v.player.wait(ctx, m) {
+			return nil
+		}
+		seg, ok := v.queue.pop(ctx)
+		if !ok {
+			return nil
+		}
+
+		if seg.init != "" && seg.init != v.lastInit {
+			if err := v.fetch(ctx, segment{url: seg.init}, m); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				m.Count(SegmentErrors, 1)
+				return err
+			}
+			v.lastInit = seg.init
+		}
+
+		if err := v.fetch(ctx, seg, m); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// Servers may refuse to hold a hinted part; the part is simply missed.
+			if seg.hint {
+				m.Count(PreloadHintErrors, 1)
+				continue
+			}
+			m.Count(SegmentErrors, 1)
+			countVariant(m, seg.variant, 0, err)
+			if failures++; failures >= maxSegmentErrors {
+				return err
+			}
+			continue
+		}
+		failures = 0
+		v.segments.Add(1)
+		v.player.append(seg.duration, seg.end, m)
+	}
+}
+
+func (v *viewer) fetch(ctx context.Context, seg segment, m *core.Meter) error {
+	ctx, cancel := context.WithTimeout(ctx, max(3*seg.duration, minSegmentTimeout))
+	defer cancel()
+
+	start := time.Now()
+	req, err := v.request(ctx, seg.url, m)
+	if err != nil {
+		return err
+	}
+	if seg.byteRange != "" {
+		req.Header.Set("Range", seg.byteRange)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusNotFound, http.StatusGone:
+		m.Count(MissingSegments, 1)
+		return core.Error(core.FailStatus(resp.StatusCode))
+	default:
+		return core.Error(core.FailStatus(resp.StatusCode))
+	}
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return err
+	}
+
+	elapsed := time.Since(start)
+	m.Data(int(n))
+	countVariant(m, seg.variant, n, nil)
+	if seg.partial {
+		m.Count(Parts, 1)
+	}
+
+	// A hinted part is requested before it exists, so its download time says
+	// nothing about the server or the network.
+	if seg.hint {
+		return nil
+	}
+	if seg.partial {
+		m.Observe(PartTime, elapsed)
+	} else {
+		m.Observe(SegmentTime, elapsed)
+		m.Count(SegmentDownloadMs, elapsed.Milliseconds())
+		if seg.variant != "" {
+			m.Observe(SegmentTime+"_"+seg.variant, elapsed)
+		}
+		// Init segments have no duration and are left out of the throughput.
+		if seg.duration > 0 && elapsed > 0 {
+			m.Record(SegmentKbps, int64(float64(n*8)/elapsed.Seconds()/1000))
+		}
+	}
+	if seg.duration > 0 && elapsed > seg.duration {
+		m.Count(SlowSegments, 1)
+	}
+
+	if v.abr != nil && seg.duration > 0 {
+		if wanted := v.abr.pick(v.variants, n, elapsed); wanted != int(v.wanted.Load()) {
+			v.wanted.Store(int64(wanted))
+			select {
+			case v.switchCh <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+func (v *viewer) request(ctx context.Context, target string, m *core.Meter) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, core.Error(core.Fail(core.ReasonClient, err))
+	}
+	if traceparent := m.Traceparent(); traceparent != "" {
+		req.Header.Set("Traceparent", traceparent)
+	}
+	return req, nil
+}
+
+// queue hands segments from the reloader to the downloader.
+type queue struct {
+	mu    sync.Mutex
+	items []segment
+	ended bool
+	wake  chan struct{}
+}
+
+func newQueue() *queue {
+	return &queue{wake: make(chan struct{}, 1)}
+}
+
+func (q *queue) push(segments ...segment) {
+	q.mu.Lock()
+	q.items = append(q.items, segments...)
+	q.mu.Unlock()
+	q.signal()
+}
+
+// replace swaps the queued segments for the ones build returns. build learns
+// the first segment that was still queued, if any.
+func (q *queue) replace(build func(first segment, queued bool) []segment) {
+	q.mu.Lock()
+	if len(q.items) > 0 {
+		q.items = build(q.items[0], true)
+	} else {
+		q.items = build(segment{}, false)
+	}
+	q.mu.Unlock()
+	q.signal()
+}
+
+// end marks that no more segments will be pushed.
+func (q *queue) end() {
+	q.mu.Lock()
+	q.ended = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for the next segment. It returns false once the queue has ended
+// and is drained, or when ctx is done.
+func (q *queue) pop(ctx context.Context) (segment, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			s := q.items[0]
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			return s, true
+		}
+		ended := q.ended
+		q.mu.Unlock()
+
+		if ended {
+			return segment{}, false
+		}
+		select {
+		case <-ctx.Done():
+			return segment{}, false
+		case <-q.wake:
+		}
+	}
+}
@@ -2,202 +2,188 @@ package hls
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
 	"sync/atomic"
 	"time"
 
 	"github.com/belalakhter/packages/api_tester/internal/core"
-	"github.com/belalakhter/packages/api_tester/utils"
 	"github.com/bluenviron/gohlslib"
 )
 
-func RunHlsTest(ctx context.Context, addr string, initialCount int64, PumpCount int64, duration int64) {
-	var global atomic.Uint64
-	global.Store(0)
-	Signal := make(chan int, 10000)
+// Config is the hls block of config.yaml.
+type Config struct {
+	// Mode "decode" (default) plays the stream with gohlslib; "fetch" loads
+	// playlists and segments itself and measures them.
+	Mode    string        `yaml:"mode"`
+	Player  PlayerConfig  `yaml:"player"`
+	Variant VariantConfig `yaml:"variant"`
+	// LowLatency loads LL-HLS streams part by part with blocking playlist reloads.
+	LowLatency bool `yaml:"low_latency"`
+}
 
-	result := core.Result{
-		InitialCount: initialCount,
-		Passed:       0,
-		Failed:       0,
-		StopCount:    utils.CalculateStopCount(initialCount, PumpCount),
-	}
+type Protocol struct {
+	addr    string
+	fetch   bool
+	player  playerSettings
+	variant variantSettings
 
-	go func() {
-		RunBufferStreamTest(ctx, result, PumpCount, addr, Signal, duration, &global)
-	}()
+	lowLatency bool
+}
 
-	for {
-		sig := <-Signal
-		switch sig {
-		case 1:
-			result.Failed++
-		case 2:
-			result.Passed++
-		}
+type user struct {
+	addr     string
+	client   *gohlslib.Client
+	waitCh   chan error
+	received atomic.Int64
+}
 
-		if global.Load() == uint64(result.StopCount) {
-			resp, err := json.Marshal(result)
-			if err != nil {
-				utils.LogMessage(err.Error(), utils.Fatal_Error_Code)
-			}
-			utils.LogMessage(string(resp), utils.Log_Info)
-			break
-		}
+func New(addr string, cfg Config) (*Protocol, error) {
+	p := &Protocol{addr: addr, lowLatency: cfg.LowLatency}
+	switch cfg.Mode {
+	case "", "decode":
+	case "fetch":
+		p.fetch = true
+	default:
+		return nil, fmt.Errorf("unknown hls mode: %s. Supported modes: decode, fetch", cfg.Mode)
+	}
+
+	var err error
+	if p.player, err = cfg.Player.compile(); err != nil {
+		return nil, err
 	}
+	if p.variant, err = cfg.Variant.compile(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Protocol) NewUser(id int64) core.VirtualUser {
+	if p.fetch {
+		return newViewer(p, id)
+	}
+	return &user{addr: p.addr}
 }
 
-func RunBufferStreamTest(ctx context.Context, result core.Result, PumpCount int64, addr string, signal chan int, d int64, counter *atomic.Uint64) {
-	utils.WelComePrint(
-		fmt.Sprintf("Addr Given %v", addr),
-		fmt.Sprintf("Count Given %v", result.InitialCount),
-		fmt.Sprintf("Duration Given %v", d),
-		fmt.Sprintf("PumpCount %v", PumpCount),
-	)
+func (u *user) Dial(ctx context.Context, m *core.Meter) error {
+	tracksCh := make(chan struct{})
 
-	for {
-		for i := 0; i < int(result.InitialCount); i++ {
-			go func() {
-				HlsIoLoop(ctx, addr, signal, d, counter)
-			}()
+	u.client = &gohlslib.Client{
+		URI: u.addr,
+	}
+
+	u.client.OnTracks = func(tracks []*gohlslib.Track) error {
+		onData := func(n int) {
+			u.received.Add(1)
+			m.Data(n)
 		}
 
-		utils.LogMessage(fmt.Sprintf("Users Dispatched %v", result.InitialCount), 3)
+		for _, track := range tracks {
+			u.client.OnDataH26x(track, func(pts time.Duration, dts time.Duration, au [][]byte) {
+				onData(unitsSize(au))
+			})
+
+			u.client.OnDataMPEG4Audio(track, func(pts time.Duration, aus [][]byte) {
+				onData(unitsSize(aus))
+			})
+
+			u.client.OnDataOpus(track, func(pts time.Duration, packets [][]byte) {
+				onData(unitsSize(packets))
+			})
 
-		if PumpCount == 0 {
-			break
+			u.client.OnDataVP9(track, func(pts time.Duration, frame []byte) {
+				onData(len(frame))
+			})
+
+			u.client.OnDataAV1(track, func(pts time.Duration, tu [][]byte) {
+				onData(unitsSize(tu))
+			})
 		}
 
-		PumpCount--
-		result.InitialCount = result.InitialCount * 2
-		time.Sleep(time.Second * 1)
+		close(tracksCh)
+		return nil
 	}
-}
 
-func HlsIoLoop(ctx context.Context, addr string, signal chan int, d int64, counter *atomic.Uint64) {
-	if d > 0 {
-		duration := time.Second * time.Duration(d)
+	if err := u.client.Start(); err != nil {
+		u.client = nil
+		return core.Error(core.Fail(core.ReasonClient, err))
+	}
 
-		connCtx, cancel := context.WithTimeout(ctx, duration+time.Second*5) // Extra buffer for HLS startup
-		defer cancel()
+	u.waitCh = make(chan error, 1)
+	go func() {
+		u.waitCh <- <-u.client.Wait()
+	}()
 
-		client := &gohlslib.Client{
-			URI: addr,
+	select {
+	case <-tracksCh:
+		return nil
+	case err := <-u.waitCh:
+		if err == nil {
+			return core.Error(core.Fail(core.ReasonServerClose, errors.New("stream ended before tracks were received")))
 		}
+		return core.Error(clientFailure(err))
+	case <-ctx.Done():
+		return core.Error(core.Fail(core.ReasonDial, errors.New("no tracks received before the session deadline")))
+	}
+}
 
-		dataReceived := false
-		segmentsReceived := 0
-
-		client.OnTracks = func(tracks []*gohlslib.Track) error {
-			utils.LogMessage(fmt.Sprintf("HLS tracks received: %d", len(tracks)), utils.Log_Info)
-
-			for _, track := range tracks {
-				client.OnDataH26x(track, func(pts time.Duration, dts time.Duration, au [][]byte) {
-					dataReceived = true
-					segmentsReceived++
-				})
-
-				client.OnDataMPEG4Audio(track, func(pts time.Duration, aus [][]byte) {
-					dataReceived = true
-					segmentsReceived++
-				})
-
-				client.OnDataOpus(track, func(pts time.Duration, packets [][]byte) {
-					dataReceived = true
-					segmentsReceived++
-				})
-
-				client.OnDataVP9(track, func(pts time.Duration, frame []byte) {
-					dataReceived = true
-					segmentsReceived++
-				})
-
-				client.OnDataAV1(track, func(pts time.Duration, tu [][]byte) {
-					dataReceived = true
-					segmentsReceived++
-				})
+func (u *user) Run(ctx context.Context, m *core.Meter) error {
+	healthTicker := time.NewTicker(time.Second * 2)
+	defer healthTicker.Stop()
+
+	start := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if u.received.Load() == 0 {
+				return core.Error(core.Fail(core.ReasonIdleTimeout, errors.New("no data received")))
 			}
 			return nil
-		}
 
-		err := client.Start()
-		if err != nil {
-			signal <- 1
-			counter.Add(1)
-			return
-		}
+		case err := <-u.waitCh:
+			if err != nil {
+				return core.Error(clientFailure(err))
+			}
+			if u.received.Load() == 0 {
+				return core.Error(core.Fail(core.ReasonServerClose, errors.New("stream ended before any data")))
+			}
+			return nil
 
-		defer func() {
-			client.Close()
-		}()
-
-		waitCh := client.Wait()
-		timeout := time.After(duration)
-
-		healthTicker := time.NewTicker(time.Second * 2)
-		defer healthTicker.Stop()
-
-		lastSegmentTime := time.Now()
-
-		for {
-			select {
-			case <-timeout:
-				if dataReceived {
-					utils.LogMessage(fmt.Sprintf("HLS client completed successfully. Segments received: %d", segmentsReceived), utils.Log_Info)
-					signal <- 2
-				} else {
-					utils.LogMessage("HLS client completed but no data received", utils.Log_Info)
-					signal <- 1
-				}
-				counter.Add(1)
-				return
-
-			case <-connCtx.Done():
-				if dataReceived {
-					signal <- 2
-				} else {
-					signal <- 1
-				}
-				counter.Add(1)
-				return
-
-			case err := <-waitCh:
-				if err != nil {
-					utils.LogMessage(fmt.Sprintf("HLS client error: %v", err), utils.Log_Info)
-					signal <- 1
-				} else {
-					if dataReceived {
-						signal <- 2
-					} else {
-						signal <- 1
-					}
-				}
-				counter.Add(1)
-				return
-
-			case <-healthTicker.C:
-				if dataReceived {
-					currentSegments := segmentsReceived
-					if currentSegments > 0 {
-						lastSegmentTime = time.Now()
-					} else if time.Since(lastSegmentTime) > time.Second*10 {
-						utils.LogMessage("HLS health check failed: no segments received for 10 seconds", utils.Log_Info)
-						signal <- 1
-						counter.Add(1)
-						return
-					}
-				} else if time.Since(lastSegmentTime) > time.Second*8 {
-					utils.LogMessage("HLS health check failed: no initial data received", utils.Log_Info)
-					signal <- 1
-					counter.Add(1)
-					return
-				}
+		case <-healthTicker.C:
+			if u.received.Load() == 0 && time.Since(start) > time.Second*8 {
+				return core.Error(core.Fail(core.ReasonIdleTimeout, errors.New("no initial data received")))
 			}
 		}
-	} else {
-		utils.LogMessage("Timeout should be > 0 seconds for HLS", utils.Fatal_Error_Code)
-		signal <- 1
-		counter.Add(1)
 	}
 }
+
+func (u *user) Close() error {
+	if u.client != nil {
+		u.client.Close()
+	}
+	return nil
+}
+
+func unitsSize(units [][]byte) int {
+	n := 0
+	for _, unit := range units {
+		n += len(unit)
+	}
+	return n
+}
+
+func clientFailure(err error) core.Outcome {
+	var status int
+	if _, scanErr := fmt.Sscanf(err.Error(), "bad status code: %d", &status); scanErr == nil {
+		return core.FailStatus(status)
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return core.DialFailure(err)
+	}
+
+	return core.Fail(core.ReasonProtocol, err)
+}
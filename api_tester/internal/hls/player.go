@@ -0,0 +1,238 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+)
+
+const (
+	StartupTime  = "startup_time"
+	Rebuffers    = "rebuffers"
+	RebufferTime = "rebuffer_time"
+
+	defaultStartupBuffer = time.Second * 2
+	defaultTargetBuffer  = time.Second * 30
+	defaultStallTimeout  = time.Second * 10
+	playerTick           = time.Millisecond * 250
+)
+
+// PlayerConfig tunes the player buffer simulated in fetch mode.
+type PlayerConfig struct {
+	StartupBuffer core.Duration `yaml:"startup_buffer"`
+	TargetBuffer  core.Duration `yaml:"target_buffer"`
+	StallTimeout  core.Duration `yaml:"stall_timeout"`
+}
+
+type playerSettings struct {
+	startupBuffer time.Duration
+	targetBuffer  time.Duration
+	stallTimeout  time.Duration
+}
+
+func (c PlayerConfig) compile() (playerSettings, error) {
+	if c.StartupBuffer < 0 || c.TargetBuffer < 0 || c.StallTimeout < 0 {
+		return playerSettings{}, fmt.Errorf("hls player durations must not be negative")
+	}
+
+	s := playerSettings{
+		startupBuffer: time.Duration(c.StartupBuffer),
+		targetBuffer:  time.Duration(c.TargetBuffer),
+		stallTimeout:  time.Duration(c.StallTimeout),
+	}
+	if s.startupBuffer == 0 {
+		s.startupBuffer = defaultStartupBuffer
+	}
+	if s.targetBuffer == 0 {
+		s.targetBuffer = defaultTargetBuffer
+	}
+	if s.stallTimeout == 0 {
+		s.stallTimeout = defaultStallTimeout
+	}
+	if s.targetBuffer < s.startupBuffer {
+		return playerSettings{}, fmt.Errorf("hls player target_buffer must be at least startup_buffer")
+	}
+	return s, nil
+}
+
+// player simulates the buffer of a video player. Downloaded segments fill
+// it, playback drains it in real time, and when it runs dry playback stalls
+// until startup_buffer is available again.
+type player struct {
+	playerSettings
+	mu        sync.Mutex
+	opened    time.Time
+	at        time.Time
+	buffered  time.Duration
+	playing   bool
+	started   bool
+	ended     bool
+	stalledAt time.Time
+	played    time.Duration
+	stalled   time.Duration
+
+	reportedPlayed  int64
+	reportedStalled int64
+}
+
+func newPlayer(s playerSettings) *player {
+	return &player{playerSettings: s}
+}
+
+// open starts the clock that startup_time is measured from.
+func (p *player) open(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.opened, p.at = now, now
+}
+
+// append adds a downloaded segment to the buffer. With the program date
+// time its media ends at, the distance of the playhead from the live edge
+// is recorded: everything downloaded is either late or still buffered.
+func (p *player) append(d time.Duration, end time.Time, m *core.Meter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.advance(now, m)
+	p.buffered += d
+	p.resume(now, m)
+
+	if p.playing && !end.IsZero() {
+		m.Observe(LiveLatency, now.Sub(end)+p.buffered)
+	}
+}
+
+// end marks that no more segments will arrive; what is buffered plays out.
+func (p *player) end(m *core.Meter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.advance(now, m)
+	p.ended = true
+	p.resume(now, m)
+}
+
+// wait blocks while the buffer holds target_buffer or more, as players stop
+// downloading ahead at that point. It returns false when ctx is done.
+func (p *player) wait(ctx context.Context, m *core.Meter) bool {
+	for {
+		p.mu.Lock()
+		p.advance(time.Now(), m)
+		excess := p.buffered - p.targetBuffer
+		p.mu.Unlock()
+
+		if excess < 0 {
+			return true
+		}
+
+		timer := time.NewTimer(excess)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+// check advances playback and reports whether the buffer has played out
+// after the end of the stream. Playback that has not started, or has stalled,
+// for longer than stall_timeout fails the session.
+func (p *player) check(m *core.Meter) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.advance(now, m)
+	p.report(now, m)
+
+	switch {
+	case p.playing:
+		return false, nil
+	case p.ended:
+		return true, nil
+	case !p.started && now.Sub(p.opened) > p.stallTimeout:
+		return false, core.Error(core.Fail(core.ReasonIdleTimeout, fmt.Errorf("playback did not start within %v", p.stallTimeout)))
+	case p.started && now.Sub(p.stalledAt) > p.stallTimeout:
+		return false, core.Error(core.Fail(core.ReasonIdleTimeout, fmt.Errorf("playback stalled for %v", p.stallTimeout)))
+	}
+	return false, nil
+}
+
+// settle reports the playback and stall time accumulated until now.
+func (p *player) settle(m *core.Meter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.advance(now, m)
+	p.report(now, m)
+}
+
+// advance plays the buffer up to now. Running dry before the end of the
+// stream is a rebuffer.
+func (p *player) advance(now time.Time, m *core.Meter) {
+	elapsed := now.Sub(p.at)
+	p.at = now
+	if !p.playing || elapsed <= 0 {
+		return
+	}
+
+	if elapsed < p.buffered {
+		p.buffered -= elapsed
+		p.played += elapsed
+		return
+	}
+
+	p.played += p.buffered
+	p.stalledAt = now.Add(p.buffered - elapsed)
+	p.buffered = 0
+	p.playing = false
+	if !p.ended {
+		m.Count(Rebuffers, 1)
+	}
+}
+
+// resume starts playback once startup_buffer is available, or whatever is
+// left after the end of the stream.
+func (p *player) resume(now time.Time, m *core.Meter) {
+	if p.playing || p.buffered == 0 {
+		return
+	}
+	if p.buffered < p.startupBuffer && !p.ended {
+		return
+	}
+
+	if !p.started {
+		p.started = true
+		m.Observe(StartupTime, now.Sub(p.opened))
+	} else {
+		stall := now.Sub(p.stalledAt)
+		p.stalled += stall
+		m.Observe(RebufferTime, stall)
+	}
+	p.playing = true
+}
+
+// report adds the played and stalled milliseconds since the last report to
+// the counters, including a stall that is still going on.
+func (p *player) report(now time.Time, m *core.Meter) {
+	stalled := p.stalled
+	if p.started && !p.playing && !p.ended {
+		stalled += now.Sub(p.stalledAt)
+	}
+
+	played := p.played.Milliseconds()
+	m.Count(core.PlayedMs, played-p.reportedPlayed)
+	p.reportedPlayed = played
+
+	stalledMs := stalled.Milliseconds()
+	m.Count(core.StalledMs, stalledMs-p.reportedStalled)
+	p.reportedStalled = stalledMs
+}
@@ -0,0 +1,232 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+	"github.com/bluenviron/gohlslib/pkg/playlist"
+)
+
+// loadPlaylist fetches and parses a multivariant or media playlist.
+func (v *viewer) loadPlaylist(ctx context.Context, u *url.URL, m *core.Meter) (playlist.Playlist, error) {
+	start := time.Now()
+	req, err := v.request(ctx, u.String(), m)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, core.Error(core.FailStatus(resp.StatusCode))
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPlaylistSize))
+	if err != nil {
+		return nil, err
+	}
+	// A blocking reload is held by the server on purpose.
+	if !u.Query().Has("_HLS_msn") {
+		m.Observe(PlaylistTime, time.Since(start))
+	}
+
+	pl, err := playlist.Unmarshal(body)
+	if err != nil {
+		return nil, core.Error(core.Fail(core.ReasonProtocol, fmt.Errorf("invalid playlist %s: %v", u, err)))
+	}
+	return pl, nil
+}
+
+func (v *viewer) loadMedia(ctx context.Context, u *url.URL, m *core.Meter) (*playlist.Media, error) {
+	pl, err := v.loadPlaylist(ctx, u, m)
+	if err != nil {
+		return nil, err
+	}
+	media, ok := pl.(*playlist.Media)
+	if !ok {
+		return nil, core.Error(core.Fail(core.ReasonProtocol, fmt.Errorf("%s is not a media playlist", u)))
+	}
+	return media, nil
+}
+
+// update queues the segments of a freshly loaded media playlist that were
+// not queued yet and reports whether there were any.
+func (v *viewer) update(media *playlist.Media, m *core.Meter) bool {
+	next, nextPart := v.next, v.nextPart
+	segments := v.collect(media, m)
+	v.media = media
+
+	v.queue.push(segments...)
+	if media.Endlist {
+		v.queue.end()
+	}
+	return v.next != next || v.nextPart != nextPart
+}
+
+// collect returns the segments of a media playlist from the next media
+// sequence number on. Segments that left the playlist before they could be
+// queued are counted as skipped. In low latency mode the segment in progress
+// is loaded part by part, starting with the preload hint.
+func (v *viewer) collect(media *playlist.Media, m *core.Meter) []segment {
+	first := v.media == nil
+	end := media.MediaSequence + len(media.Segments)
+	parts := v.lowLatency && media.PartInf != nil && !media.Endlist
+	if first {
+		v.next, v.nextPart = media.MediaSequence, 0
+		switch {
+		case media.Endlist:
+		case parts:
+			v.next = end
+		case len(media.Segments) > liveEdgeSegments:
+			v.next = end - liveEdgeSegments
+		}
+	}
+	if v.next < media.MediaSequence {
+		m.Count(SkippedSegments, int64(media.MediaSequence-v.next))
+		v.next, v.nextPart, v.partTime = media.MediaSequence, 0, 0
+	}
+
+	var init, name string
+	if media.Map != nil {
+		init = v.resolve(media.Map.URI)
+	}
+	if v.variants != nil {
+		name = v.variants[v.current].name
+	}
+
+	starts := dateTimes(media)
+	var out []segment
+	for ; v.next < end; v.next++ {
+		i := v.next - media.MediaSequence
+		seg := media.Segments[i]
+
+		if seg.Gap {
+			v.nextPart, v.partTime = 0, 0
+			continue
+		}
+
+		// The first parts of this segment were loaded already: finish it with the rest.
+		if v.nextPart > 0 && len(seg.Parts) > 0 {
+			out = append(out, v.parts(seg.Parts, v.next, starts[i])...)
+			v.nextPart, v.partTime = 0, 0
+			continue
+		}
+
+		// Without its parts, for example after a late blocking reload, the rest
+		// of a segment can only be loaded with the whole segment; only the media
+		// not loaded as parts yet counts towards the buffer.
+		s := segment{seq: v.next, url: v.resolve(seg.URI), duration: max(seg.Duration-v.partTime, 0)}
+		v.nextPart, v.partTime = 0, 0
+		s.byteRange = v.byteRange(s.url, seg.ByteRangeStart, seg.ByteRangeLength)
+		if !starts[i].IsZero() {
+			s.end = starts[i].Add(seg.Duration)
+		}
+		out = append(out, s)
+	}
+
+	v.listed = 0
+	if parts {
+		out = append(out, v.parts(media.Parts, end, starts[len(media.Segments)])...)
+		v.listed = len(media.Parts)
+		if hint := media.PreloadHint; hint != nil && v.nextPart == len(media.Parts) {
+			s := segment{seq: end, part: v.nextPart, partial: true, hint: true, url: v.resolve(hint.URI), duration: media.PartInf.PartTarget}
+			for _, p := range media.Parts {
+				s.offset += p.Duration
+			}
+			v.partTime = s.offset + s.duration
+			start := hint.ByteRangeStart
+			s.byteRange = v.byteRange(s.url, &start, hint.ByteRangeLength)
+			if start := starts[len(media.Segments)]; !start.IsZero() {
+				s.end = start.Add(s.offset + s.duration)
+			}
+			out = append(out, s)
+			v.nextPart++
+			m.Count(PreloadHints, 1)
+		}
+	}
+
+	for i := range out {
+		out[i].init, out[i].variant = init, name
+	}
+	return out
+}
+
+// parts returns the parts of segment seq from nextPart on and advances
+// nextPart and partTime past them.
+func (v *viewer) parts(parts []*playlist.MediaPart, seq int, start time.Time) []segment {
+	var out []segment
+	offset := time.Duration(0)
+	for i, p := range parts {
+		offset += p.Duration
+		if i < v.nextPart || p.Gap {
+			continue
+		}
+
+		s := segment{seq: seq, part: i, partial: true, offset: offset - p.Duration, url: v.resolve(p.URI), duration: p.Duration}
+		v.partTime = offset
+		s.byteRange = v.byteRange(s.url, p.ByteRangeStart, p.ByteRangeLength)
+		if !start.IsZero() {
+			s.end = start.Add(offset)
+		}
+		out = append(out, s)
+	}
+	v.nextPart = max(v.nextPart, len(parts))
+	return out
+}
+
+// byteRange returns the Range header for a slice of a resource. Without an
+// explicit start a range continues where the previous one of the same
+// resource ended; without a length it runs to the end of the resource.
+func (v *viewer) byteRange(u string, start *uint64, length *uint64) string {
+	if length == nil {
+		if start == nil || *start == 0 {
+			return ""
+		}
+		v.rangeURL = ""
+		return fmt.Sprintf("bytes=%d-", *start)
+	}
+
+	var from uint64
+	if start != nil {
+		from = *start
+	} else if u == v.rangeURL {
+		from = v.rangeEnd
+	}
+	v.rangeURL, v.rangeEnd = u, from+*length
+	return fmt.Sprintf("bytes=%d-%d", from, from+*length-1)
+}
+
+// dateTimes maps every segment, and the one in progress after them, to its
+// EXT-X-PROGRAM-DATE-TIME. Segments without the tag continue from the
+// previous one; the result is zero until the playlist has a date.
+func dateTimes(media *playlist.Media) []time.Time {
+	out := make([]time.Time, len(media.Segments)+1)
+	var next time.Time
+	for i, seg := range media.Segments {
+		if seg.DateTime != nil {
+			next = *seg.DateTime
+		}
+		out[i] = next
+		if !next.IsZero() {
+			next = next.Add(seg.Duration)
+		}
+	}
+	out[len(media.Segments)] = next
+	return out
+}
+
+func (v *viewer) resolve(ref string) string {
+	u, err := v.mediaURL.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return u.String()
+}
@@ -0,0 +1,159 @@
+package hls
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+	"github.com/bluenviron/gohlslib/pkg/playlist"
+)
+
+func TestByteRange(t *testing.T) {
+	u64 := func(v uint64) *uint64 { return &v }
+
+	v := &viewer{}
+	tests := []struct {
+		name   string
+		url    string
+		start  *uint64
+		length *uint64
+		want   string
+	}{
+		{name: "whole resource", url: "a.ts", want: ""},
+		{name: "explicit", url: "a.ts", start: u64(100), length: u64(50), want: "bytes=100-149"},
+		{name: "continues", url: "a.ts", length: u64(10), want: "bytes=150-159"},
+		{name: "other resource starts at zero", url: "b.ts", length: u64(10), want: "bytes=0-9"},
+		{name: "continues other resource", url: "b.ts", length: u64(5), want: "bytes=10-14"},
+		{name: "open ended", url: "b.ts", start: u64(15), want: "bytes=15-"},
+		{name: "open ended breaks the chain", url: "b.ts", length: u64(5), want: "bytes=0-4"},
+		{name: "zero start without length", url: "c.ts", start: u64(0), want: ""},
+	}
+
+	// The cases run in order: each continues from the ranges before it.
+	for _, tt := range tests {
+		if got := v.byteRange(tt.url, tt.start, tt.length); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// mediaPlaylist renders a live playlist of 2s segments from seq on. Segments
+// listed in parts carry two 1s parts, and open adds a segment in progress
+// with one part and a preload hint for the next.
+func mediaPlaylist(seq, count int, parts map[int]bool, open bool) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:9\n#EXT-X-TARGETDURATION:2\n")
+	b.WriteString("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3\n#EXT-X-PART-INF:PART-TARGET=1\n")
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", seq)
+	for n := seq; n < seq+count; n++ {
+		if parts[n] {
+			fmt.Fprintf(&b, "#EXT-X-PART:DURATION=1,URI=\"p%d.0.ts\",INDEPENDENT=YES\n", n)
+			fmt.Fprintf(&b, "#EXT-X-PART:DURATION=1,URI=\"p%d.1.ts\"\n", n)
+		}
+		fmt.Fprintf(&b, "#EXTINF:2,\ns%d.ts\n", n)
+	}
+	if open {
+		n := seq + count
+		fmt.Fprintf(&b, "#EXT-X-PART:DURATION=1,URI=\"p%d.0.ts\",INDEPENDENT=YES\n", n)
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"p%d.1.ts\"\n", n)
+	}
+	return b.String()
+}
+
+func TestCollect(t *testing.T) {
+	type step struct {
+		playlist string
+		want     []string
+	}
+	tests := []struct {
+		name       string
+		lowLatency bool
+		steps      []step
+		skipped    int64
+	}{
+		{
+			name: "starts at the live edge",
+			steps: []step{
+				{playlist: mediaPlaylist(10, 5, nil, false), want: []string{"s12.ts 2s", "s13.ts 2s", "s14.ts 2s"}},
+				{playlist: mediaPlaylist(11, 5, nil, false), want: []string{"s15.ts 2s"}},
+				{playlist: mediaPlaylist(11, 5, nil, false)},
+			},
+		},
+		{
+			name: "short live playlist starts at the beginning",
+			steps: []step{
+				{playlist: mediaPlaylist(0, 2, nil, false), want: []string{"s0.ts 2s", "s1.ts 2s"}},
+			},
+		},
+		{
+			name: "counts segments that left the playlist",
+			steps: []step{
+				{playlist: mediaPlaylist(10, 5, nil, false), want: []string{"s12.ts 2s", "s13.ts 2s", "s14.ts 2s"}},
+				{playlist: mediaPlaylist(17, 3, nil, false), want: []string{"s17.ts 2s", "s18.ts 2s", "s19.ts 2s"}},
+			},
+			skipped: 2,
+		},
+		{
+			name:       "low latency continues with the remaining parts",
+			lowLatency: true,
+			steps: []step{
+				{playlist: mediaPlaylist(10, 3, map[int]bool{12: true}, true), want: []string{"p13.0.ts 1s", "p13.1.ts 1s hint"}},
+				{playlist: mediaPlaylist(10, 4, map[int]bool{13: true}, true), want: []string{"p14.0.ts 1s", "p14.1.ts 1s hint"}},
+			},
+		},
+		{
+			name:       "low latency loads segments whose parts left the playlist whole",
+			lowLatency: true,
+			steps: []step{
+				{playlist: mediaPlaylist(10, 3, nil, true), want: []string{"p13.0.ts 1s", "p13.1.ts 1s hint"}},
+				{playlist: mediaPlaylist(11, 4, nil, true), want: []string{"s13.ts 0s", "s14.ts 2s", "p15.0.ts 1s", "p15.1.ts 1s hint"}},
+			},
+		},
+		{
+			name:       "low latency counts only the media not loaded as parts",
+			lowLatency: true,
+			steps: []step{
+				{playlist: mediaPlaylist(10, 3, nil, true), want: []string{"p13.0.ts 1s", "p13.1.ts 1s hint"}},
+				{playlist: strings.Replace(mediaPlaylist(11, 3, nil, false), "#EXTINF:2,\ns13.ts", "#EXTINF:3,\ns13.ts", 1), want: []string{"s13.ts 1s"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, _ := url.Parse("http://example.com/live/index.m3u8")
+			v := &viewer{mediaURL: base, lowLatency: tt.lowLatency}
+			stats := core.NewStats()
+			m := core.NewMeter(stats)
+
+			for i, s := range tt.steps {
+				pl, err := playlist.Unmarshal([]byte(s.playlist))
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				media := pl.(*playlist.Media)
+
+				var got []string
+				for _, seg := range v.collect(media, m) {
+					desc := fmt.Sprintf("%s %v", strings.TrimPrefix(seg.url, "http://example.com/live/"), seg.duration)
+					if seg.hint {
+						desc += " hint"
+					}
+					got = append(got, desc)
+				}
+				v.media = media
+
+				if !reflect.DeepEqual(got, s.want) {
+					t.Errorf("step %d: got %q, want %q", i, got, s.want)
+				}
+			}
+
+			if n := stats.Counters()[SkippedSegments]; n != tt.skipped {
+				t.Errorf("%s = %d, want %d", SkippedSegments, n, tt.skipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package hls
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+	"github.com/bluenviron/gohlslib/pkg/playlist"
+)
+
+const (
+	VariantSwitches = "variant_switches"
+	VariantSegments = "variant_segments"
+	VariantBytes    = "variant_bytes"
+	VariantErrors   = "variant_errors"
+
+	// abrSafety is the share of the estimated throughput a variant may need.
+	abrSafety = 0.8
+	// abrFast and abrSlow weigh the newest sample in the two throughput
+	// averages; the lower average counts, so drops are followed quickly.
+	abrFast = 0.5
+	abrSlow = 0.1
+)
+
+// VariantConfig chooses the variant of a multivariant playlist a user plays.
+// Weights, keyed by variant name ("1600k") or resolution ("1280x720"), spread
+// users over variants with the distribution strategy.
+type VariantConfig struct {
+	Strategy string         `yaml:"strategy"`
+	Weights  map[string]int `yaml:"weights"`
+}
+
+type variantSettings struct {
+	strategy string
+	weights  map[string]int
+}
+
+func (c VariantConfig) compile() (variantSettings, error) {
+	s := variantSettings{strategy: c.Strategy, weights: c.Weights}
+	switch s.strategy {
+	case "":
+		s.strategy = "highest"
+	case "highest", "lowest", "random", "abr":
+	case "distribution":
+		if len(s.weights) == 0 {
+			return s, fmt.Errorf("hls variant distribution needs weights")
+		}
+		for name, w := range s.weights {
+			if w < 0 {
+				return s, fmt.Errorf("hls variant weight %s must not be negative", name)
+			}
+		}
+	default:
+		return s, fmt.Errorf("unknown hls variant strategy: %s. Supported strategies: highest, lowest, random, abr, distribution", s.strategy)
+	}
+
+	if len(s.weights) > 0 && s.strategy != "distribution" {
+		return s, fmt.Errorf("hls variant weights only apply to the distribution strategy")
+	}
+	return s, nil
+}
+
+type variant struct {
+	name       string
+	resolution string
+	bandwidth  int
+	url        *url.URL
+}
+
+// variants lists the variants of a multivariant playlist from the lowest to
+// the highest bandwidth, named after their bandwidth in kbit/s.
+func variants(master *playlist.Multivariant, base *url.URL) ([]variant, error) {
+	out := make([]variant, 0, len(master.Variants))
+	for _, mv := range master.Variants {
+		u, err := base.Parse(mv.URI)
+		if err != nil {
+			return nil, fmt.Errorf("invalid variant uri %q: %v", mv.URI, err)
+		}
+		out = append(out, variant{resolution: mv.Resolution, bandwidth: mv.Bandwidth, url: u})
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].bandwidth < out[j].bandwidth
+	})
+
+	seen := make(map[string]int)
+	for i := range out {
+		name := fmt.Sprintf("%dk", out[i].bandwidth/1000)
+		if seen[name]++; seen[name] > 1 {
+			name = fmt.Sprintf("%s_%d", name, seen[name])
+		}
+		out[i].name = name
+	}
+	return out, nil
+}
+
+// choose returns the index of the variant a user starts with. ABR starts low
+// and climbs as throughput allows.
+func (s variantSettings) choose(vs []variant, user int64) (int, error) {
+	switch s.strategy {
+	case "lowest", "abr":
+		return 0, nil
+	case "random":
+		return rand.Intn(len(vs)), nil
+	case "distribution":
+		total := 0
+		for _, v := range vs {
+			total += s.weight(v)
+		}
+		if total == 0 {
+			return 0, fmt.Errorf("no variant matches the hls variant weights")
+		}
+
+		pos := int(user % int64(total))
+		for i, v := range vs {
+			if pos < s.weight(v) {
+				return i, nil
+			}
+			pos -= s.weight(v)
+		}
+	}
+	return len(vs) - 1, nil
+}
+
+func (s variantSettings) weight(v variant) int {
+	if w, ok := s.weights[v.name]; ok {
+		return w
+	}
+	return s.weights[v.resolution]
+}
+
+// abr estimates throughput from segment downloads, like players do, and
+// picks the highest variant it can sustain. Only the downloader uses it.
+type abr struct {
+	fast float64
+	slow float64
+}
+
+func (a *abr) pick(vs []variant, bytes int64, elapsed time.Duration) int {
+	if bytes > 0 && elapsed > 0 {
+		bps := float64(bytes*8) / elapsed.Seconds()
+		if a.fast == 0 {
+			a.fast, a.slow = bps, bps
+		} else {
+			a.fast = abrFast*bps + (1-abrFast)*a.fast
+			a.slow = abrSlow*bps + (1-abrSlow)*a.slow
+		}
+	}
+
+	estimate := min(a.fast, a.slow)
+	best := 0
+	for i, v := range vs {
+		if float64(v.bandwidth) <= estimate*abrSafety {
+			best = i
+		}
+	}
+	return best
+}
+
+// countVariant adds a segment outcome to the load counters of its variant.
+func countVariant(m *core.Meter, name string, bytes int64, err error) {
+	if name == "" {
+		return
+	}
+	if err != nil {
+		m.Count(VariantErrors+"."+name, 1)
+		return
+	}
+	m.Count(VariantSegments+"."+name, 1)
+	m.Count(VariantBytes+"."+name, bytes)
+}
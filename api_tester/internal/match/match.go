@@ -0,0 +1,151 @@
+package match
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Config describes a message matcher. JSON selects a value with a dotted path
+// such as "data.items[0].id"; the message matches when the path exists and,
+// if set, the value equals Equals and matches Regex. Without JSON, Regex is
+// applied to the raw message.
+type Config struct {
+	JSON   string `yaml:"json"`
+	Equals string `yaml:"equals"`
+	Regex  string `yaml:"regex"`
+}
+
+type Matcher struct {
+	path   []string
+	equals string
+	regex  *regexp.Regexp
+}
+
+func (c Config) Compile() (*Matcher, error) {
+	if c.JSON == "" && c.Regex == "" {
+		return nil, fmt.Errorf("match needs json or regex")
+	}
+
+	m := &Matcher{equals: c.Equals}
+	if c.JSON != "" {
+		path, err := ParsePath(c.JSON)
+		if err != nil {
+			return nil, err
+		}
+		m.path = path
+	} else if c.Equals != "" {
+		return nil, fmt.Errorf("match equals needs a json path")
+	}
+
+	if c.Regex != "" {
+		re, err := regexp.Compile(c.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %v", c.Regex, err)
+		}
+		m.regex = re
+	}
+	return m, nil
+}
+
+func (m *Matcher) Match(msg []byte) bool {
+	if m.path == nil {
+		return m.regex.Match(msg)
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(msg, &doc); err != nil {
+		return false
+	}
+	value, ok := Lookup(doc, m.path)
+	if !ok {
+		return false
+	}
+
+	s := String(value)
+	if m.equals != "" && s != m.equals {
+		return false
+	}
+	if m.regex != nil && !m.regex.MatchString(s) {
+		return false
+	}
+	return true
+}
+
+// ParsePath splits "a.b[2].c" (optionally prefixed with "$.") into keys and indexes.
+func ParsePath(path string) ([]string, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return nil, fmt.Errorf("empty json path")
+	}
+
+	var out []string
+	for _, part := range strings.Split(path, ".") {
+		key, rest, _ := strings.Cut(part, "[")
+		if key != "" {
+			out = append(out, key)
+		}
+		for rest != "" {
+			index, next, found := strings.Cut(rest, "]")
+			if !found {
+				return nil, fmt.Errorf("invalid json path %q", path)
+			}
+			if _, err := strconv.Atoi(index); err != nil {
+				return nil, fmt.Errorf("invalid index %q in json path %q", index, path)
+			}
+			out = append(out, "["+index)
+			rest = strings.TrimPrefix(next, "[")
+		}
+		if key == "" && !strings.Contains(part, "[") {
+			return nil, fmt.Errorf("invalid json path %q", path)
+		}
+	}
+	return out, nil
+}
+
+// Lookup walks a decoded JSON document along a parsed path.
+func Lookup(doc interface{}, path []string) (interface{}, bool) {
+	current := doc
+	for _, key := range path {
+		if strings.HasPrefix(key, "[") {
+			list, ok := current.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			i, _ := strconv.Atoi(key[1:])
+			if i < 0 || i >= len(list) {
+				return nil, false
+			}
+			current = list[i]
+			continue
+		}
+
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = object[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// String formats a JSON value the way it is written in configs: strings as is,
+// numbers without exponent, everything else re-encoded.
+func String(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return "null"
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
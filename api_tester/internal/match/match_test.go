@@ -0,0 +1,80 @@
+package match
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    []string
+		invalid bool
+	}{
+		{path: "id", want: []string{"id"}},
+		{path: "data.items[0].id", want: []string{"data", "items", "[0", "id"}},
+		{path: "$.data.id", want: []string{"data", "id"}},
+		{path: "$[1]", want: []string{"[1"}},
+		{path: "grid[2][3]", want: []string{"grid", "[2", "[3"}},
+		{path: "[0].name", want: []string{"[0", "name"}},
+		{path: "", invalid: true},
+		{path: "$", invalid: true},
+		{path: "a..b", invalid: true},
+		{path: "items[x]", invalid: true},
+		{path: "items[0", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := ParsePath(tt.path)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("parsed %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	msg := []byte(`{"type":"tick","seq":42,"data":{"items":[{"id":"a1"},{"id":null}]}}`)
+
+	tests := []struct {
+		name string
+		cfg  Config
+		want bool
+	}{
+		{name: "path exists", cfg: Config{JSON: "data.items[0].id"}, want: true},
+		{name: "path missing", cfg: Config{JSON: "data.items[2].id"}, want: false},
+		{name: "equals string", cfg: Config{JSON: "type", Equals: "tick"}, want: true},
+		{name: "equals number", cfg: Config{JSON: "seq", Equals: "42"}, want: true},
+		{name: "equals null", cfg: Config{JSON: "data.items[1].id", Equals: "null"}, want: true},
+		{name: "equals differs", cfg: Config{JSON: "type", Equals: "tock"}, want: false},
+		{name: "regex on value", cfg: Config{JSON: "data.items[0].id", Regex: `^a\d$`}, want: true},
+		{name: "regex on raw", cfg: Config{Regex: `"seq":4\d`}, want: true},
+		{name: "index into object", cfg: Config{JSON: "data[0]"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := tt.cfg.Compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.Match(msg); got != tt.want {
+				t.Errorf("Match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if m, err := (Config{JSON: "type"}).Compile(); err != nil || m.Match([]byte("not json")) {
+		t.Errorf("non-JSON message matched a json path")
+	}
+}
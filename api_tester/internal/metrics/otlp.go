@@ -0,0 +1,467 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+	"github.com/belalakhter/packages/api_tester/utils"
+)
+
+const (
+	defaultOTLPInterval = time.Second * 10
+	otlpTimeout         = time.Second * 10
+	maxPendingSpans     = 10000
+	spanBatchSize       = 512
+
+	temporalityCumulative = 2
+	spanKindInternal      = 1
+	spanKindClient        = 3
+	statusOK              = 1
+	statusError           = 2
+)
+
+type OTLPConfig struct {
+	Endpoint string            `yaml:"endpoint"`
+	Interval core.Duration     `yaml:"interval"`
+	Headers  map[string]string `yaml:"headers"`
+}
+
+// OTLP pushes metrics and per-session spans to a collector over OTLP/HTTP
+// using the JSON encoding. Metrics are cumulative and sent every Interval;
+// spans are batched and dropped when the collector falls behind.
+type OTLP struct {
+	cfg      OTLPConfig
+	resource otlpResource
+	client   *http.Client
+	engine   *core.Engine
+	start    time.Time
+	spans    chan core.SessionTrace
+	dropped  atomic.Int64
+	failing  atomic.Bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewOTLP(cfg OTLPConfig, name, protocol string) *OTLP {
+	if cfg.Interval <= 0 {
+		cfg.Interval = core.Duration(defaultOTLPInterval)
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+
+	return &OTLP{
+		cfg: cfg,
+		resource: otlpResource{Attributes: []otlpKeyValue{
+			stringAttr("service.name", "api_tester"),
+			stringAttr("test.name", name),
+			stringAttr("test.protocol", protocol),
+		}},
+		client: &http.Client{Timeout: otlpTimeout},
+		spans:  make(chan core.SessionTrace, maxPendingSpans),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Span queues the spans of a finished session. It never blocks the engine.
+func (o *OTLP) Span(t core.SessionTrace) {
+	select {
+	case o.spans <- t:
+	default:
+		o.dropped.Add(1)
+	}
+}
+
+func (o *OTLP) Start(engine *core.Engine) {
+	o.engine = engine
+	o.start = time.Now()
+	go o.loop()
+}
+
+// Stop flushes the pending spans and the final metrics.
+func (o *OTLP) Stop() {
+	close(o.stop)
+	<-o.done
+
+	if dropped := o.dropped.Load(); dropped > 0 {
+		utils.LogMessage(fmt.Sprintf("OTLP exporter dropped %d sessions", dropped), utils.Debug_Error_Code)
+	}
+}
+
+func (o *OTLP) loop() {
+	defer close(o.done)
+
+	ticker := time.NewTicker(time.Duration(o.cfg.Interval))
+	defer ticker.Stop()
+
+	var pending []core.SessionTrace
+	for {
+		select {
+		case t := <-o.spans:
+			pending = append(pending, t)
+			if len(pending) >= spanBatchSize {
+				o.exportSpans(pending)
+				pending = nil
+			}
+		case <-ticker.C:
+			o.exportSpans(pending)
+			pending = nil
+			o.exportMetrics()
+		case <-o.stop:
+		drain:
+			for {
+				select {
+				case t := <-o.spans:
+					pending = append(pending, t)
+				default:
+					break drain
+				}
+			}
+			o.exportSpans(pending)
+			o.exportMetrics()
+			return
+		}
+	}
+}
+
+func (o *OTLP) post(path string, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		utils.LogMessage(fmt.Sprintf("Failed to encode OTLP payload: %v", err), utils.Debug_Error_Code)
+		return
+	}
+
+	err = o.send(path, data)
+	if err != nil && !o.failing.Swap(true) {
+		utils.LogMessage(fmt.Sprintf("OTLP export failed: %v", err), utils.Debug_Error_Code)
+	} else if err == nil && o.failing.Swap(false) {
+		utils.LogMessage("OTLP export recovered", utils.Log_Info)
+	}
+}
+
+func (o *OTLP) send(path string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", o.cfg.Endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range o.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned status %d", path, resp.StatusCode)
+	}
+	return nil
+}
+
+func (o *OTLP) exportMetrics() {
+	res := o.engine.Snapshot()
+	start := unixNano(o.start)
+	now := unixNano(time.Now())
+
+	point := func(value int64, attrs ...otlpKeyValue) otlpNumberPoint {
+		return otlpNumberPoint{Attributes: attrs, StartTimeUnixNano: start, TimeUnixNano: now, AsInt: strconv.FormatInt(value, 10)}
+	}
+	counter := func(name, unit, description string, points ...otlpNumberPoint) otlpMetric {
+		return otlpMetric{
+			Name:        name,
+			Unit:        unit,
+			Description: description,
+			Sum: &otlpSum{
+				AggregationTemporality: temporalityCumulative,
+				IsMonotonic:            true,
+				DataPoints:             points,
+			},
+		}
+	}
+
+	list := []otlpMetric{
+		{
+			Name:        "api_tester.active_users",
+			Unit:        "{user}",
+			Description: "Virtual users currently running.",
+			Gauge:       &otlpGauge{DataPoints: []otlpNumberPoint{{TimeUnixNano: now, AsInt: strconv.FormatInt(res.Active, 10)}}},
+		},
+		counter("api_tester.connection_attempts", "{session}", "Sessions started by virtual users.", point(res.StopCount)),
+		counter("api_tester.connections", "{session}", "Sessions that established a connection.", point(res.Connects)),
+		counter("api_tester.sessions", "{session}", "Finished sessions by outcome.",
+			point(res.Passed, stringAttr("outcome", "passed")),
+			point(res.Failed, stringAttr("outcome", "failed"))),
+		counter("api_tester.dropped", "{session}", "Arrivals dropped because max_in_flight was reached.", point(res.Dropped)),
+		counter("api_tester.received_bytes", "By", "Payload bytes received.", point(res.BytesReceived)),
+		counter("api_tester.received_messages", "{message}", "Messages received.", point(res.MessagesReceived)),
+	}
+
+	if len(res.Failures) > 0 {
+		var points []otlpNumberPoint
+		for reason, count := range res.Failures {
+			points = append(points, point(count, stringAttr("reason", string(reason))))
+		}
+		list = append(list, counter("api_tester.failures", "{session}", "Failed sessions by reason.", points...))
+	}
+
+	if len(res.Counters) > 0 {
+		var points []otlpNumberPoint
+		for name, count := range res.Counters {
+			points = append(points, point(count, stringAttr("event", name)))
+		}
+		list = append(list, counter("api_tester.events", "{event}", "Protocol specific events such as timeouts or reconnects.", points...))
+	}
+
+	latency := otlpMetric{
+		Name:        "api_tester.latency",
+		Unit:        "s",
+		Description: "Latencies observed by virtual users.",
+		Histogram:   &otlpHistogram{AggregationTemporality: temporalityCumulative},
+	}
+	histograms := o.engine.Stats().Histograms()
+	names := make([]string, 0, len(histograms))
+	for name := range histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		h := histograms[name]
+		dp := otlpHistogramPoint{
+			Attributes:        []otlpKeyValue{stringAttr("metric", name)},
+			StartTimeUnixNano: start,
+			TimeUnixNano:      now,
+			Sum:               float64(h.Sum()) / 1e6,
+			ExplicitBounds:    latencyBuckets,
+		}
+		var below int64
+		for _, le := range latencyBuckets {
+			count := h.CountAtOrBelow(time.Duration(le * float64(time.Second)).Microseconds())
+			dp.BucketCounts = append(dp.BucketCounts, strconv.FormatInt(count-below, 10))
+			below = count
+		}
+		total := max(h.Count(), below)
+		dp.BucketCounts = append(dp.BucketCounts, strconv.FormatInt(total-below, 10))
+		dp.Count = strconv.FormatInt(total, 10)
+		latency.Histogram.DataPoints = append(latency.Histogram.DataPoints, dp)
+	}
+	list = append(list, latency)
+
+	o.post("/v1/metrics", map[string]interface{}{
+		"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource": o.resource,
+			"scopeMetrics": []interface{}{map[string]interface{}{
+				"scope":   otlpScope{Name: "api_tester"},
+				"metrics": list,
+			}},
+		}},
+	})
+}
+
+func (o *OTLP) exportSpans(traces []core.SessionTrace) {
+	if len(traces) == 0 {
+		return
+	}
+
+	var spans []otlpSpan
+	for _, t := range traces {
+		spans = append(spans, sessionSpans(t)...)
+	}
+
+	o.post("/v1/traces", map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": o.resource,
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": otlpScope{Name: "api_tester"},
+				"spans": spans,
+			}},
+		}},
+	})
+}
+
+// sessionSpans turns a session timeline into a client span with one child per
+// phase: dial, handshake, first_message and close.
+func sessionSpans(t core.SessionTrace) []otlpSpan {
+	traceID := hex.EncodeToString(t.TraceID[:])
+	parentID := hex.EncodeToString(t.SpanID[:])
+
+	status := otlpStatus{Code: statusOK}
+	if !t.Outcome.Passed {
+		status = otlpStatus{Code: statusError, Message: t.Outcome.Err}
+	}
+
+	attrs := []otlpKeyValue{
+		intAttr("vu.id", t.User),
+		intAttr("messages", t.Messages),
+		stringAttr("outcome", outcomeName(t.Outcome)),
+	}
+	if !t.Outcome.Passed {
+		attrs = append(attrs, stringAttr("failure.reason", string(t.Outcome.Reason)))
+	}
+	if t.Outcome.StatusCode != 0 {
+		attrs = append(attrs, intAttr("http.response.status_code", int64(t.Outcome.StatusCode)))
+	}
+	if t.Outcome.CloseCode != 0 {
+		attrs = append(attrs, intAttr("close.code", int64(t.Outcome.CloseCode)))
+	}
+
+	spans := []otlpSpan{{
+		TraceID:           traceID,
+		SpanID:            parentID,
+		Name:              "session",
+		Kind:              spanKindClient,
+		StartTimeUnixNano: unixNano(t.Start),
+		EndTimeUnixNano:   unixNano(t.End),
+		Attributes:        attrs,
+		Status:            status,
+	}}
+
+	child := func(name string, start, end time.Time, failed bool) {
+		s := otlpSpan{
+			TraceID:           traceID,
+			SpanID:            spanID(),
+			ParentSpanID:      parentID,
+			Name:              name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: unixNano(start),
+			EndTimeUnixNano:   unixNano(end),
+			Status:            otlpStatus{Code: statusOK},
+		}
+		if failed {
+			s.Status = status
+		}
+		spans = append(spans, s)
+	}
+
+	connected := !t.Connected.IsZero()
+	dialEnd, handshakeEnd := t.Dialed, t.Connected
+	if !connected {
+		handshakeEnd = t.Closing
+	}
+	if t.Dialed.IsZero() {
+		dialEnd = handshakeEnd
+	}
+
+	child("dial", t.Start, dialEnd, !connected && t.Dialed.IsZero())
+	if !t.Dialed.IsZero() {
+		child("handshake", t.Dialed, handshakeEnd, !connected)
+	}
+	if !t.FirstData.IsZero() {
+		child("first_message", t.Connected, t.FirstData, false)
+	}
+	child("close", t.Closing, t.End, false)
+
+	return spans
+}
+
+func outcomeName(o core.Outcome) string {
+	if o.Passed {
+		return "passed"
+	}
+	return "failed"
+}
+
+func spanID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func stringAttr(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: map[string]interface{}{"stringValue": value}}
+}
+
+func intAttr(key string, value int64) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}}
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Unit        string         `json:"unit,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+	DataPoints             []otlpNumberPoint `json:"dataPoints"`
+}
+
+type otlpNumberPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt"`
+}
+
+type otlpHistogram struct {
+	AggregationTemporality int                  `json:"aggregationTemporality"`
+	DataPoints             []otlpHistogramPoint `json:"dataPoints"`
+}
+
+type otlpHistogramPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
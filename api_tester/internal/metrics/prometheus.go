@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+)
+
+// latencyBuckets are the upper bounds of the exported histograms in seconds.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Prometheus exposes the live state of an engine in the Prometheus text format.
+type Prometheus struct {
+	protocol string
+	engine   *core.Engine
+}
+
+func NewPrometheus(protocol string, engine *core.Engine) *Prometheus {
+	return &Prometheus{protocol: protocol, engine: engine}
+}
+
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.Write(w)
+}
+
+func (p *Prometheus) Write(w io.Writer) {
+	res := p.engine.Snapshot()
+	proto := label("protocol", p.protocol)
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("api_tester_active_users", "gauge", "Virtual users currently running.")
+	fmt.Fprintf(w, "api_tester_active_users{%s} %d\n", proto, res.Active)
+
+	metric("api_tester_connection_attempts_total", "counter", "Sessions started by virtual users.")
+	fmt.Fprintf(w, "api_tester_connection_attempts_total{%s} %d\n", proto, res.StopCount)
+
+	metric("api_tester_connections_total", "counter", "Sessions that established a connection.")
+	fmt.Fprintf(w, "api_tester_connections_total{%s} %d\n", proto, res.Connects)
+
+	metric("api_tester_sessions_total", "counter", "Finished sessions by outcome.")
+	fmt.Fprintf(w, "api_tester_sessions_total{%s,outcome=\"passed\"} %d\n", proto, res.Passed)
+	fmt.Fprintf(w, "api_tester_sessions_total{%s,outcome=\"failed\"} %d\n", proto, res.Failed)
+
+	metric("api_tester_failures_total", "counter", "Failed sessions by reason.")
+	reasons := make([]string, 0, len(res.Failures))
+	for reason := range res.Failures {
+		reasons = append(reasons, string(reason))
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "api_tester_failures_total{%s,%s} %d\n", proto, label("reason", reason), res.Failures[core.FailureReason(reason)])
+	}
+
+	metric("api_tester_dropped_total", "counter", "Arrivals dropped because max_in_flight was reached.")
+	fmt.Fprintf(w, "api_tester_dropped_total{%s} %d\n", proto, res.Dropped)
+
+	metric("api_tester_received_bytes_total", "counter", "Payload bytes received.")
+	fmt.Fprintf(w, "api_tester_received_bytes_total{%s} %d\n", proto, res.BytesReceived)
+
+	metric("api_tester_received_messages_total", "counter", "Messages received.")
+	fmt.Fprintf(w, "api_tester_received_messages_total{%s} %d\n", proto, res.MessagesReceived)
+
+	metric("api_tester_events_total", "counter", "Protocol specific events such as timeouts or reconnects.")
+	events := make([]string, 0, len(res.Counters))
+	for name := range res.Counters {
+		events = append(events, name)
+	}
+	sort.Strings(events)
+	for _, name := range events {
+		fmt.Fprintf(w, "api_tester_events_total{%s,%s} %d\n", proto, label("event", name), res.Counters[name])
+	}
+
+	metric("api_tester_latency_seconds", "histogram", "Latencies observed by virtual users.")
+	histograms := p.engine.Stats().Histograms()
+	names := make([]string, 0, len(histograms))
+	for name := range histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		h := histograms[name]
+		labels := proto + "," + label("metric", name)
+		for _, le := range latencyBuckets {
+			bound := time.Duration(le * float64(time.Second)).Microseconds()
+			fmt.Fprintf(w, "api_tester_latency_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(le), h.CountAtOrBelow(bound))
+		}
+		fmt.Fprintf(w, "api_tester_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.Count())
+		fmt.Fprintf(w, "api_tester_latency_seconds_sum{%s} %s\n", labels, formatFloat(float64(h.Sum())/1e6))
+		fmt.Fprintf(w, "api_tester_latency_seconds_count{%s} %d\n", labels, h.Count())
+	}
+}
+
+// labelEscaper escapes label values as the text format requires; counter
+// names such as event_type.<type> come from the server under test.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(v float64) string {
+	s := fmt.Sprintf("%f", v)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+)
+
+func TestPrometheusScrape(t *testing.T) {
+	engine := core.NewEngine(core.Options{}, nil)
+	hostile := "event_type.a\"b\\c\nd"
+	engine.Stats().Count(hostile, 3)
+	engine.Stats().Count("reconnects", 1)
+	engine.Stats().Observe("rtt", 20*time.Millisecond)
+	engine.Stats().Observe("segment_time_1600k", time.Second)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", NewPrometheus("sse", engine))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	events := make(map[string]string)
+	scanner := bufio.NewScanner(resp.Body)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+			continue
+		}
+		name, labels, value, err := parseSample(line)
+		if err != nil {
+			t.Fatalf("line %d %q: %v", n, line, err)
+		}
+		if labels["protocol"] != "sse" {
+			t.Errorf("line %d: protocol label %q", n, labels["protocol"])
+		}
+		if name == "api_tester_events_total" {
+			events[labels["event"]] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if events[hostile] != "3" {
+		t.Errorf("hostile event name did not round trip: %q", events)
+	}
+	if events["reconnects"] != "1" {
+		t.Errorf("reconnects = %q", events["reconnects"])
+	}
+}
+
+// parseSample parses one sample line of the text exposition format.
+func parseSample(line string) (string, map[string]string, string, error) {
+	i := 0
+	for i < len(line) && (line[i] == '_' || line[i] == ':' || line[i] >= 'a' && line[i] <= 'z' ||
+		line[i] >= 'A' && line[i] <= 'Z' || i > 0 && line[i] >= '0' && line[i] <= '9') {
+		i++
+	}
+	if i == 0 {
+		return "", nil, "", fmt.Errorf("missing metric name")
+	}
+	name := line[:i]
+
+	labels := make(map[string]string)
+	if i < len(line) && line[i] == '{' {
+		i++
+		for line[i] != '}' {
+			eq := strings.IndexByte(line[i:], '=')
+			if eq <= 0 || i+eq+1 >= len(line) || line[i+eq+1] != '"' {
+				return "", nil, "", fmt.Errorf("malformed label at %d", i)
+			}
+			key := line[i : i+eq]
+			i += eq + 2
+
+			var value strings.Builder
+			for {
+				if i >= len(line) {
+					return "", nil, "", fmt.Errorf("unterminated label value")
+				}
+				c := line[i]
+				i++
+				if c == '"' {
+					break
+				}
+				if c != '\\' {
+					value.WriteByte(c)
+					continue
+				}
+				if i >= len(line) {
+					return "", nil, "", fmt.Errorf("dangling escape")
+				}
+				switch line[i] {
+				case '\\', '"':
+					value.WriteByte(line[i])
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					return "", nil, "", fmt.Errorf("invalid escape \\%c", line[i])
+				}
+				i++
+			}
+			labels[key] = value.String()
+
+			if i >= len(line) {
+				return "", nil, "", fmt.Errorf("unterminated label set")
+			}
+			if line[i] == ',' {
+				i++
+			} else if line[i] != '}' {
+				return "", nil, "", fmt.Errorf("unexpected %q after label", line[i])
+			}
+		}
+		i++
+	}
+
+	if i >= len(line) || line[i] != ' ' {
+		return "", nil, "", fmt.Errorf("missing value")
+	}
+	value := line[i+1:]
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return "", nil, "", fmt.Errorf("invalid value %q", value)
+	}
+	return name, labels, value, nil
+}
@@ -0,0 +1,179 @@
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+)
+
+const (
+	chartWidth  = 640
+	chartHeight = 200
+	chartPad    = 30
+)
+
+type htmlPage struct {
+	Report
+	Checks  []junitCase
+	Latency []latencyRow
+	Charts  []template.HTML
+}
+
+type latencyRow struct {
+	Name string
+	core.LatencySummary
+}
+
+var page = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>api_tester {{.Type}} {{.Addr}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.fail { color: #b00020; font-weight: bold; }
+.pass { color: #1b7f3b; font-weight: bold; }
+svg { border: 1px solid #ddd; margin: 0 1em 1em 0; }
+</style>
+</head>
+<body>
+<h1>api_tester {{.Type}}</h1>
+<p>{{.Addr}}{{if .Result.Interrupted}} &mdash; <span class="fail">interrupted: {{.Result.InterruptReason}}</span>{{end}}</p>
+
+<h2>Checks</h2>
+<table>
+<tr><th>check</th><th>status</th><th>detail</th></tr>
+{{range .Checks}}<tr><td>{{.Name}}</td>{{if .Failure}}<td class="fail">failed</td><td>{{.Failure.Message}}</td>{{else}}<td class="pass">passed</td><td></td>{{end}}</tr>
+{{end}}</table>
+
+<h2>Summary</h2>
+<table>
+<tr><th>elapsed</th><td>{{printf "%.1f" .Result.Elapsed}}s</td></tr>
+<tr><th>sessions</th><td>{{.Result.StopCount}}</td></tr>
+<tr><th>connects</th><td>{{.Result.Connects}}</td></tr>
+<tr><th>passed</th><td>{{.Result.Passed}}</td></tr>
+<tr><th>failed</th><td>{{.Result.Failed}}</td></tr>
+<tr><th>dropped</th><td>{{.Result.Dropped}}</td></tr>
+<tr><th>bytes received</th><td>{{.Result.BytesReceived}}</td></tr>
+<tr><th>messages received</th><td>{{.Result.MessagesReceived}}</td></tr>
+</table>
+
+{{if .Result.Failures}}<h2>Failures</h2>
+<table>
+<tr><th>reason</th><th>count</th></tr>
+{{range $reason, $count := .Result.Failures}}<tr><td>{{$reason}}</td><td>{{$count}}</td></tr>
+{{end}}</table>
+{{end}}
+
+{{if .Result.Counters}}<h2>Events</h2>
+<table>
+<tr><th>event</th><th>count</th></tr>
+{{range $name, $count := .Result.Counters}}<tr><td>{{$name}}</td><td>{{$count}}</td></tr>
+{{end}}</table>
+{{end}}
+
+{{if .Result.Values}}<h2>Values</h2>
+<table>
+<tr><th>metric</th><th>count</th><th>min</th><th>p50</th><th>p90</th><th>p99</th><th>max</th></tr>
+{{range $name, $v := .Result.Values}}<tr><td>{{$name}}</td><td>{{$v.Count}}</td><td>{{$v.Min}}</td><td>{{$v.P50}}</td><td>{{$v.P90}}</td><td>{{$v.P99}}</td><td>{{$v.Max}}</td></tr>
+{{end}}</table>
+{{end}}
+
+<h2>Latency (ms)</h2>
+<table>
+<tr><th>metric</th><th>count</th><th>p50</th><th>p90</th><th>p99</th><th>p99.9</th><th>max</th></tr>
+{{range .Latency}}<tr><td>{{.Name}}</td><td>{{.Count}}</td><td>{{.P50}}</td><td>{{.P90}}</td><td>{{.P99}}</td><td>{{.P999}}</td><td>{{.Max}}</td></tr>
+{{end}}</table>
+
+<h2>Time series</h2>
+{{range .Charts}}{{.}}{{end}}
+</body>
+</html>
+`))
+
+func writeHTML(w io.Writer, r Report) error {
+	p := htmlPage{
+		Report: r,
+		Checks: checks(r),
+	}
+
+	for name, summary := range r.Result.Latency {
+		p.Latency = append(p.Latency, latencyRow{Name: name, LatencySummary: summary})
+	}
+	sort.Slice(p.Latency, func(i, j int) bool {
+		return p.Latency[i].Name < p.Latency[j].Name
+	})
+
+	series := r.Result.Series
+	elapsed := make([]float64, len(series))
+	active := make([]float64, len(series))
+	connects := make([]float64, len(series))
+	messages := make([]float64, len(series))
+	failures := make([]float64, len(series))
+	connectP99 := make([]float64, len(series))
+
+	for i, s := range series {
+		elapsed[i] = s.Elapsed
+		active[i] = float64(s.Active)
+		connects[i] = float64(s.NewConnects)
+		messages[i] = s.MessagesPerSec
+		for _, count := range s.NewFailures {
+			failures[i] += float64(count)
+		}
+		connectP99[i] = s.Latency[core.ConnectTime].P99
+	}
+
+	p.Charts = []template.HTML{
+		chart("Active users", elapsed, active),
+		chart("New connects per sample", elapsed, connects),
+		chart("Messages / s", elapsed, messages),
+		chart("Failures per sample", elapsed, failures),
+		chart("Connect time p99 per sample (ms)", elapsed, connectP99),
+	}
+
+	return page.Execute(w, p)
+}
+
+// chart renders a self-contained SVG line chart.
+func chart(title string, xs []float64, ys []float64) template.HTML {
+	var maxX, maxY float64
+	for i := range xs {
+		maxX = max(maxX, xs[i])
+		maxY = max(maxY, ys[i])
+	}
+	if maxX == 0 {
+		maxX = 1
+	}
+	if maxY == 0 {
+		maxY = 1
+	}
+
+	plotW := float64(chartWidth - 2*chartPad)
+	plotH := float64(chartHeight - 2*chartPad)
+
+	points := make([]string, len(xs))
+	for i := range xs {
+		x := chartPad + xs[i]/maxX*plotW
+		y := chartPad + plotH - ys[i]/maxY*plotH
+		points[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`, chartWidth, chartHeight)
+	fmt.Fprintf(&b, `<text x="%d" y="18" font-size="13">%s</text>`, chartPad, template.HTMLEscapeString(title))
+	fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#999"/>`, chartPad, chartHeight-chartPad, chartWidth-chartPad, chartHeight-chartPad)
+	fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#999"/>`, chartPad, chartPad, chartPad, chartHeight-chartPad)
+	fmt.Fprintf(&b, `<text x="2" y="%d" font-size="10">%.4g</text>`, chartPad+4, maxY)
+	fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="10" text-anchor="end">%.0fs</text>`, chartWidth-chartPad, chartHeight-chartPad+14, maxX)
+	fmt.Fprintf(&b, `<polyline fill="none" stroke="#3366cc" stroke-width="2" points="%s"/>`, strings.Join(points, " "))
+	b.WriteString(`</svg>`)
+
+	return template.HTML(b.String())
+}
@@ -0,0 +1,270 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+)
+
+const (
+	FormatJSON  = "json"
+	FormatJUnit = "junit"
+	FormatCSV   = "csv"
+	FormatHTML  = "html"
+)
+
+type Config struct {
+	Path   string `yaml:"path"`
+	Format string `yaml:"format"`
+}
+
+// Report is everything a report writer needs to describe a finished run.
+type Report struct {
+	Type   string
+	Addr   string
+	Result core.Result
+}
+
+// Resolve validates the config and infers the format from the file extension when it is not set.
+func (c Config) Resolve() (Config, error) {
+	if c.Path == "" {
+		return c, fmt.Errorf("report path is required")
+	}
+
+	if c.Format == "" {
+		switch strings.ToLower(filepath.Ext(c.Path)) {
+		case ".json":
+			c.Format = FormatJSON
+		case ".xml":
+			c.Format = FormatJUnit
+		case ".csv":
+			c.Format = FormatCSV
+		case ".html", ".htm":
+			c.Format = FormatHTML
+		default:
+			return c, fmt.Errorf("cannot infer report format from %s, set format", c.Path)
+		}
+	}
+
+	switch c.Format {
+	case FormatJSON, FormatJUnit, FormatCSV, FormatHTML:
+		return c, nil
+	default:
+		return c, fmt.Errorf("unknown report format: %s. Supported formats: json, junit, csv, html", c.Format)
+	}
+}
+
+func Write(cfg Config, r Report) error {
+	file, err := os.Create(cfg.Path)
+	if err != nil {
+		return fmt.Errorf("failed to create report %s: %v", cfg.Path, err)
+	}
+	defer file.Close()
+
+	switch cfg.Format {
+	case FormatJSON:
+		err = writeJSON(file, r)
+	case FormatJUnit:
+		err = writeJUnit(file, r)
+	case FormatCSV:
+		err = writeCSV(file, r)
+	case FormatHTML:
+		err = writeHTML(file, r)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s report %s: %v", cfg.Format, cfg.Path, err)
+	}
+	return file.Close()
+}
+
+func writeJSON(w io.Writer, r Report) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// checks turns the result into pass/fail test cases for CI.
+func checks(r Report) []junitCase {
+	class := "api_tester." + r.Type
+	res := r.Result
+
+	var cases []junitCase
+
+	if len(res.Thresholds) == 0 {
+		sessions := junitCase{Name: "sessions", ClassName: class, Time: res.Elapsed}
+		if res.Failed > 0 {
+			sessions.Failure = &junitFailure{
+				Message: fmt.Sprintf("%d of %d sessions failed", res.Failed, res.Passed+res.Failed),
+				Body:    failureLines(res),
+			}
+		}
+		cases = append(cases, sessions)
+	}
+
+	for _, t := range res.Thresholds {
+		c := junitCase{Name: t.Threshold, ClassName: class + ".thresholds", Time: res.Elapsed}
+		if !t.Passed {
+			message := fmt.Sprintf("actual %g", t.Actual)
+			if t.Error != "" {
+				message = t.Error
+			}
+			c.Failure = &junitFailure{Message: message, Body: failureLines(res)}
+		}
+		cases = append(cases, c)
+	}
+
+	completed := junitCase{Name: "completed", ClassName: class, Time: res.Elapsed}
+	if res.Interrupted {
+		completed.Failure = &junitFailure{Message: "run interrupted: " + res.InterruptReason}
+	}
+
+	return append(cases, completed)
+}
+
+func writeJUnit(w io.Writer, r Report) error {
+	cases := checks(r)
+
+	suite := junitSuite{
+		Name:  fmt.Sprintf("api_tester %s %s", r.Type, r.Addr),
+		Tests: len(cases),
+		Time:  r.Result.Elapsed,
+		Cases: cases,
+	}
+	for _, c := range cases {
+		if c.Failure != nil {
+			suite.Failures++
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(junitSuites{Suites: []junitSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func failureLines(res core.Result) string {
+	var lines []string
+	for reason, count := range res.Failures {
+		lines = append(lines, fmt.Sprintf("%s: %d", reason, count))
+	}
+	for msg, count := range res.Errors {
+		lines = append(lines, fmt.Sprintf("%dx %s", count, msg))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func writeCSV(w io.Writer, r Report) error {
+	writer := csv.NewWriter(w)
+	series := r.Result.Series
+
+	reasonSet := make(map[core.FailureReason]bool)
+	latencySet := make(map[string]bool)
+	for _, s := range series {
+		for reason := range s.NewFailures {
+			reasonSet[reason] = true
+		}
+		for name := range s.Latency {
+			latencySet[name] = true
+		}
+	}
+
+	reasons := make([]string, 0, len(reasonSet))
+	for reason := range reasonSet {
+		reasons = append(reasons, string(reason))
+	}
+	sort.Strings(reasons)
+
+	latencies := make([]string, 0, len(latencySet))
+	for name := range latencySet {
+		latencies = append(latencies, name)
+	}
+	sort.Strings(latencies)
+
+	header := []string{"elapsed", "target", "active", "connects", "passed", "failed", "bytes", "messages", "new_connects", "bytes_per_sec", "messages_per_sec"}
+	for _, reason := range reasons {
+		header = append(header, "failures_"+reason)
+	}
+	for _, name := range latencies {
+		header = append(header, name+"_p50_ms", name+"_p90_ms", name+"_p99_ms", name+"_max_ms")
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	integer := func(v int64) string {
+		return strconv.FormatInt(v, 10)
+	}
+	float := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 3, 64)
+	}
+
+	for _, s := range series {
+		row := []string{
+			float(s.Elapsed),
+			integer(s.Target),
+			integer(s.Active),
+			integer(s.Connects),
+			integer(s.Passed),
+			integer(s.Failed),
+			integer(s.Bytes),
+			integer(s.Messages),
+			integer(s.NewConnects),
+			float(s.BytesPerSec),
+			float(s.MessagesPerSec),
+		}
+		for _, reason := range reasons {
+			row = append(row, integer(s.NewFailures[core.FailureReason(reason)]))
+		}
+		for _, name := range latencies {
+			l := s.Latency[name]
+			row = append(row, float(l.P50), float(l.P90), float(l.P99), float(l.Max))
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
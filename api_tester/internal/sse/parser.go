@@ -0,0 +1,154 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is one dispatched text/event-stream event.
+type Event struct {
+	Type  string
+	Data  string
+	ID    string
+	HasID bool
+	Retry time.Duration
+}
+
+// Parser implements the event stream interpretation of the HTML Living
+// Standard: LF, CR and CRLF line endings, comments, multi-line data, id and
+// retry fields. The last event ID persists across events as the spec requires.
+type Parser struct {
+	r           *bufio.Reader
+	started     bool
+	skipLF      bool
+	lastEventID string
+	retry       time.Duration
+	eventType   string
+	idSet       bool
+	data        strings.Builder
+	hasData     bool
+	Comments    int64
+}
+
+func NewParser(r io.Reader) *Parser {
+	return &Parser{r: bufio.NewReader(r)}
+}
+
+// Resume carries the last event ID and retry of a previous stream over to a reconnect.
+func (p *Parser) Resume(lastEventID string, retry time.Duration) {
+	p.lastEventID = lastEventID
+	p.retry = retry
+}
+
+// LastEventID is the id to resume from when reconnecting.
+func (p *Parser) LastEventID() string {
+	return p.lastEventID
+}
+
+// Retry is the reconnection time most recently sent by the server, or 0.
+func (p *Parser) Retry() time.Duration {
+	return p.retry
+}
+
+// Next returns the next event. At the end of the stream an incomplete event is
+// discarded and io.EOF returned.
+func (p *Parser) Next() (Event, error) {
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return Event{}, err
+		}
+
+		if line == "" {
+			if !p.hasData {
+				p.eventType = ""
+				p.idSet = false
+				continue
+			}
+			e := Event{
+				Type:  p.eventType,
+				Data:  strings.TrimSuffix(p.data.String(), "\n"),
+				ID:    p.lastEventID,
+				HasID: p.idSet,
+				Retry: p.retry,
+			}
+			if e.Type == "" {
+				e.Type = "message"
+			}
+			p.eventType = ""
+			p.idSet = false
+			p.data.Reset()
+			p.hasData = false
+			return e, nil
+		}
+
+		if line[0] == ':' {
+			p.Comments++
+			continue
+		}
+
+		field, value, found := strings.Cut(line, ":")
+		if found {
+			value = strings.TrimPrefix(value, " ")
+		}
+
+		switch field {
+		case "event":
+			p.eventType = value
+		case "data":
+			p.data.WriteString(value)
+			p.data.WriteByte('\n')
+			p.hasData = true
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				p.lastEventID = value
+				p.idSet = true
+			}
+		case "retry":
+			if ms, err := strconv.ParseUint(value, 10, 63); err == nil {
+				p.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
+
+// readLine returns the next line without its terminator. A CR is a complete
+// terminator on its own; an LF directly after it is skipped on the next call,
+// so a live stream never blocks waiting to see whether CR is part of CRLF.
+func (p *Parser) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := p.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		if p.skipLF {
+			p.skipLF = false
+			if b == '\n' {
+				continue
+			}
+		}
+
+		switch b {
+		case '\r':
+			p.skipLF = true
+			return p.finish(line), nil
+		case '\n':
+			return p.finish(line), nil
+		}
+		line = append(line, b)
+	}
+}
+
+func (p *Parser) finish(line []byte) string {
+	if !p.started {
+		p.started = true
+		line = bytes.TrimPrefix(line, []byte("\xEF\xBB\xBF"))
+	}
+	return string(line)
+}
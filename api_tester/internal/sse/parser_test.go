@@ -0,0 +1,145 @@
+package sse
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParser(t *testing.T) {
+	tests := []struct {
+		name     string
+		stream   string
+		events   []Event
+		comments int64
+	}{
+		{
+			name:   "lf",
+			stream: "data: a\n\ndata: b\n\n",
+			events: []Event{{Type: "message", Data: "a"}, {Type: "message", Data: "b"}},
+		},
+		{
+			name:   "crlf",
+			stream: "event: tick\r\ndata: a\r\n\r\ndata: b\r\n\r\n",
+			events: []Event{{Type: "tick", Data: "a"}, {Type: "message", Data: "b"}},
+		},
+		{
+			name:   "cr",
+			stream: "data: a\rdata: b\r\rdata: c\r\r",
+			events: []Event{{Type: "message", Data: "a\nb"}, {Type: "message", Data: "c"}},
+		},
+		{
+			name:   "mixed endings",
+			stream: "data: a\r\ndata: b\rdata: c\n\r\n",
+			events: []Event{{Type: "message", Data: "a\nb\nc"}},
+		},
+		{
+			name:   "leading bom",
+			stream: "\xEF\xBB\xBFdata: a\n\n",
+			events: []Event{{Type: "message", Data: "a"}},
+		},
+		{
+			name:   "bom only at the start",
+			stream: "data: a\n\n\xEF\xBB\xBFdata: b\n\n",
+			events: []Event{{Type: "message", Data: "a"}},
+		},
+		{
+			name:     "comments",
+			stream:   ": hello\ndata: a\n:\n\n: bye\n\n",
+			events:   []Event{{Type: "message", Data: "a"}},
+			comments: 3,
+		},
+		{
+			name:   "data without colon",
+			stream: "data\ndata\n\ndata\n\n",
+			events: []Event{{Type: "message", Data: "\n"}, {Type: "message", Data: ""}},
+		},
+		{
+			name:   "space after colon is optional",
+			stream: "data:a\ndata:  b\n\n",
+			events: []Event{{Type: "message", Data: "a\n b"}},
+		},
+		{
+			name:   "event without data is not dispatched",
+			stream: "event: ping\n\ndata: a\n\n",
+			events: []Event{{Type: "message", Data: "a"}},
+		},
+		{
+			name:   "id persists",
+			stream: "id: 1\ndata: a\n\ndata: b\n\n",
+			events: []Event{{Type: "message", Data: "a", ID: "1", HasID: true}, {Type: "message", Data: "b", ID: "1"}},
+		},
+		{
+			name:   "empty id resets",
+			stream: "id: 1\ndata: a\n\nid\ndata: b\n\nid:\ndata: c\n\n",
+			events: []Event{
+				{Type: "message", Data: "a", ID: "1", HasID: true},
+				{Type: "message", Data: "b", HasID: true},
+				{Type: "message", Data: "c", HasID: true},
+			},
+		},
+		{
+			name:   "id with nul is ignored",
+			stream: "id: 1\ndata: a\n\nid: 2\x003\ndata: b\n\n",
+			events: []Event{{Type: "message", Data: "a", ID: "1", HasID: true}, {Type: "message", Data: "b", ID: "1"}},
+		},
+		{
+			name:   "retry",
+			stream: "retry: 1500\ndata: a\n\nretry: soon\ndata: b\n\nretry: -1\nretry: 10\ndata: c\n\n",
+			events: []Event{
+				{Type: "message", Data: "a", Retry: 1500 * time.Millisecond},
+				{Type: "message", Data: "b", Retry: 1500 * time.Millisecond},
+				{Type: "message", Data: "c", Retry: 10 * time.Millisecond},
+			},
+		},
+		{
+			name:   "unknown fields are ignored",
+			stream: "foo: bar\ndata: a\n\n",
+			events: []Event{{Type: "message", Data: "a"}},
+		},
+		{
+			name:   "incomplete event at the end is discarded",
+			stream: "data: a\n\ndata: b\n",
+			events: []Event{{Type: "message", Data: "a"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser(strings.NewReader(tt.stream))
+			var events []Event
+			for {
+				e, err := p.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				events = append(events, e)
+			}
+
+			if !reflect.DeepEqual(events, tt.events) {
+				t.Errorf("events = %+v, want %+v", events, tt.events)
+			}
+			if p.Comments != tt.comments {
+				t.Errorf("comments = %d, want %d", p.Comments, tt.comments)
+			}
+		})
+	}
+}
+
+func TestParserResume(t *testing.T) {
+	p := NewParser(strings.NewReader("data: a\n\n"))
+	p.Resume("41", time.Second)
+
+	e, err := p.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ID != "41" || e.HasID || e.Retry != time.Second {
+		t.Errorf("event = %+v, want the resumed id and retry", e)
+	}
+}
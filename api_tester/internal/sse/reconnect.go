@@ -0,0 +1,108 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+)
+
+const (
+	Reconnects        = "reconnects"
+	ReconnectFailures = "reconnect_failures"
+	ReconnectTime     = "reconnect_time"
+	MissingIDs        = "missing_ids"
+	DuplicateIDs      = "duplicate_ids"
+
+	defaultRetry = time.Second * 3
+
+	// maxSeenIDs bounds the ids remembered for duplicate detection of non-numeric ids.
+	maxSeenIDs = 100000
+)
+
+type reconnectSettings struct {
+	retry      time.Duration
+	sequential bool
+}
+
+// resume waits for the retry delay and reopens the stream with Last-Event-ID.
+// Network errors are retried like EventSource does; a response other than
+// 200 ends the session, as it makes EventSource give up too. A session that
+// ends before the stream is back fails with server_close.
+func (u *user) resume(ctx context.Context, m *core.Meter) error {
+	dropped := time.Now()
+	u.resp.Body.Close()
+	disconnected := core.Error(core.Fail(core.ReasonServerClose, errors.New("stream was not resumed before the session ended")))
+
+	for {
+		delay := u.retry
+		if delay <= 0 {
+			delay = u.protocol.reconnect.retry
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return disconnected
+		case <-timer.C:
+		}
+
+		err := u.connect(ctx, m)
+		if err == nil {
+			m.Count(Reconnects, 1)
+			m.Observe(ReconnectTime, time.Since(dropped))
+			return nil
+		}
+		if ctx.Err() != nil {
+			return disconnected
+		}
+
+		var failure *core.Failure
+		if errors.As(err, &failure) {
+			return err
+		}
+		m.Count(ReconnectFailures, 1)
+	}
+}
+
+// idTracker detects event ids repeated after a resume and, for sequential
+// integer ids, the ones the server skipped.
+type idTracker struct {
+	sequential bool
+	last       int64
+	numbered   bool
+	seen       map[string]bool
+}
+
+// observe checks the id of an event. An empty id resets the last event ID,
+// so it is not tracked and the next integer id is not compared with earlier ones.
+func (t *idTracker) observe(id string, m *core.Meter) {
+	if id == "" {
+		t.numbered = false
+		return
+	}
+	if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+		if t.numbered {
+			switch {
+			case n <= t.last:
+				m.Count(DuplicateIDs, 1)
+				return
+			case t.sequential && n > t.last+1:
+				m.Count(MissingIDs, n-t.last-1)
+			}
+		}
+		t.last, t.numbered = n, true
+		return
+	}
+
+	if t.seen[id] {
+		m.Count(DuplicateIDs, 1)
+		return
+	}
+	if len(t.seen) < maxSeenIDs {
+		t.seen[id] = true
+	}
+}
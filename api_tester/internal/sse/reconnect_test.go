@@ -0,0 +1,41 @@
+package sse
+
+import (
+	"testing"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+)
+
+func TestIDTracker(t *testing.T) {
+	tests := []struct {
+		name       string
+		sequential bool
+		ids        []string
+		duplicates int64
+		missing    int64
+	}{
+		{"empty ids reset", false, []string{"a", "", "b", ""}, 0, 0},
+		{"repeated name", false, []string{"a", "b", "a"}, 1, 0},
+		{"repeated number", false, []string{"1", "2", "2", "3"}, 1, 0},
+		{"gap", true, []string{"1", "2", "5"}, 0, 2},
+		{"empty id ends numbering", true, []string{"5", "", "1", "2"}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := core.NewStats()
+			m := core.NewMeter(stats)
+			tracker := &idTracker{sequential: tt.sequential, seen: make(map[string]bool)}
+			for _, id := range tt.ids {
+				tracker.observe(id, m)
+			}
+
+			counters := stats.Counters()
+			if counters[DuplicateIDs] != tt.duplicates {
+				t.Errorf("duplicate_ids = %d, want %d", counters[DuplicateIDs], tt.duplicates)
+			}
+			if counters[MissingIDs] != tt.missing {
+				t.Errorf("missing_ids = %d, want %d", counters[MissingIDs], tt.missing)
+			}
+		})
+	}
+}
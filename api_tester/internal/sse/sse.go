@@ -1,183 +1,310 @@
 package sse
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptrace"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/belalakhter/packages/api_tester/internal/core"
-	"github.com/belalakhter/packages/api_tester/utils"
+	"github.com/belalakhter/packages/api_tester/internal/delivery"
+	"github.com/belalakhter/packages/api_tester/internal/match"
 )
 
-func RunSseTest(ctx context.Context, addr string, initialCount int64, PumpCount int64, duration int64) {
-	var global atomic.Uint64
-	global.Store(0)
-	Signal := make(chan int, 10000)
+const (
+	idleTimeout = time.Second * 5
 
-	result := core.Result{
-		InitialCount: initialCount,
-		Passed:       0,
-		Failed:       0,
-		StopCount:    utils.CalculateStopCount(initialCount, PumpCount),
-	}
+	AssertionFailures = "assertion_failures"
+	Comments          = "comments"
 
-	go func() {
-		RunHttpTest(ctx, result, PumpCount, addr, Signal, duration, &global)
-	}()
+	// maxEventTypes caps the distinct event_type.<type> counters a misbehaving server can create.
+	maxEventTypes = 50
+)
 
-	for {
-		sig := <-Signal
-		switch sig {
-		case 1:
-			result.Failed++
-		case 2:
-			result.Passed++
+// Config is the sse block of config.yaml.
+type Config struct {
+	Assertions []Assertion `yaml:"assertions"`
+
+	// Reconnect resumes dropped streams the way EventSource does, sending
+	// Last-Event-ID and waiting for the server's retry: value (Retry until one arrives).
+	Reconnect     bool          `yaml:"reconnect"`
+	Retry         core.Duration `yaml:"retry"`
+	SequentialIDs bool          `yaml:"sequential_ids"`
+
+	Delivery *delivery.Config `yaml:"delivery"`
+}
+
+// Assertion checks the data of every event of the given type (all events when
+// Event is empty). Events that do not match are counted as assertion_failures.
+type Assertion struct {
+	Name         string `yaml:"name"`
+	Event        string `yaml:"event"`
+	match.Config `yaml:",inline"`
+}
+
+type assertion struct {
+	name    string
+	event   string
+	matcher *match.Matcher
+}
+
+type Protocol struct {
+	addr       string
+	client     *http.Client
+	assertions []assertion
+	reconnect  *reconnectSettings
+	delivery   *delivery.Clock
+	mu         sync.Mutex
+	eventTypes map[string]bool
+}
+
+type user struct {
+	protocol *Protocol
+	addr     string
+	client   *http.Client
+	resp     *http.Response
+
+	lastEventID string
+	retry       time.Duration
+	ids         *idTracker
+}
+
+func New(addr string, cfg Config) (*Protocol, error) {
+	p := &Protocol{
+		addr:       addr,
+		client:     &http.Client{},
+		eventTypes: make(map[string]bool),
+	}
+
+	for i, a := range cfg.Assertions {
+		matcher, err := a.Compile()
+		if err != nil {
+			return nil, fmt.Errorf("sse assertion %d: %v", i+1, err)
 		}
+		p.assertions = append(p.assertions, assertion{name: a.Name, event: a.Event, matcher: matcher})
+	}
 
-		if global.Load() == uint64(result.StopCount) {
-			resp, err := json.Marshal(result)
-			if err != nil {
-				utils.LogMessage(err.Error(), utils.Fatal_Error_Code)
-			}
-			utils.LogMessage(string(resp), utils.Log_Info)
-			break
+	var err error
+	if p.delivery, err = cfg.Delivery.Compile(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Reconnect {
+		p.reconnect = &reconnectSettings{retry: time.Duration(cfg.Retry), sequential: cfg.SequentialIDs}
+		if p.reconnect.retry <= 0 {
+			p.reconnect.retry = defaultRetry
 		}
 	}
+	return p, nil
 }
 
-func RunHttpTest(ctx context.Context, result core.Result, PumpCount int64, addr string, signal chan int, d int64, counter *atomic.Uint64) {
-	utils.WelComePrint(
-		fmt.Sprintf("Addr Given %v", addr),
-		fmt.Sprintf("Count Given %v", result.InitialCount),
-		fmt.Sprintf("Duration Given %v", d),
-		fmt.Sprintf("PumpCount %v", PumpCount),
-	)
+func (p *Protocol) NewUser(id int64) core.VirtualUser {
+	u := &user{protocol: p, addr: p.addr, client: p.client}
+	if p.reconnect != nil {
+		u.ids = &idTracker{sequential: p.reconnect.sequential, seen: make(map[string]bool)}
+	}
+	return u
+}
 
-	for {
-		for i := 0; i < int(result.InitialCount); i++ {
-			go func() {
-				SseIoLoop(ctx, addr, signal, d, counter)
-			}()
+// eventCounter names the counter of an event type, folding types beyond maxEventTypes into "other".
+func (p *Protocol) eventCounter(eventType string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.eventTypes[eventType] {
+		if len(p.eventTypes) >= maxEventTypes {
+			return "event_type.other"
 		}
+		p.eventTypes[eventType] = true
+	}
+	return "event_type." + eventType
+}
 
-		utils.LogMessage(fmt.Sprintf("Users Dispatched %v", result.InitialCount), 3)
+func (u *user) Dial(ctx context.Context, m *core.Meter) error {
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			m.Dialed()
+		},
+	})
+	return u.connect(ctx, m)
+}
 
-		if PumpCount == 0 {
-			break
-		}
+// connect opens the event stream, resuming from the last event ID when there is one.
+func (u *user) connect(ctx context.Context, m *core.Meter) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.addr, nil)
+	if err != nil {
+		return core.Error(core.Fail(core.ReasonClient, err))
+	}
 
-		PumpCount--
-		result.InitialCount = result.InitialCount * 2
-		time.Sleep(time.Second * 1)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("Connection", "keep-alive")
+	if traceparent := m.Traceparent(); traceparent != "" {
+		req.Header.Set("Traceparent", traceparent)
+	}
+	if u.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", u.lastEventID)
 	}
-}
 
-func SseIoLoop(ctx context.Context, addr string, signal chan int, d int64, counter *atomic.Uint64) {
-	if d > 1 {
-		duration := time.Second * time.Duration(d)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	u.resp = resp
 
-		connCtx, cancel := context.WithTimeout(ctx, duration+time.Second*2)
-		defer cancel()
+	if resp.StatusCode != http.StatusOK {
+		return core.Error(core.FailStatus(resp.StatusCode))
+	}
+	return nil
+}
 
-		req, err := http.NewRequestWithContext(connCtx, "GET", addr, nil)
-		if err != nil {
-			signal <- 1
-			counter.Add(1)
-			return
+// Run parses the event stream until ctx is done. Every event counts as one
+// message; comments keep the connection from idling out but are not events.
+// With reconnect enabled a dropped stream is resumed instead of ending the session.
+func (u *user) Run(ctx context.Context, m *core.Meter) error {
+	if len(u.protocol.assertions) > 0 {
+		m.Register(AssertionFailures)
+	}
+	if u.protocol.delivery != nil {
+		u.protocol.delivery.Init(m)
+	}
+	if u.protocol.reconnect != nil {
+		m.Register(Reconnects, DuplicateIDs)
+		if u.protocol.reconnect.sequential {
+			m.Register(MissingIDs)
 		}
+	}
 
-		req.Header.Set("Accept", "text/event-stream")
-		req.Header.Set("Cache-Control", "no-cache")
-		req.Header.Set("Connection", "keep-alive")
-
-		client := &http.Client{
-			Timeout: duration + time.Second*2,
+	var received int64
+	for {
+		n, err := u.stream(ctx, m)
+		received += n
+		if ctx.Err() != nil {
+			return nil
 		}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			signal <- 1
-			counter.Add(1)
-			return
+		var failure *core.Failure
+		if u.protocol.reconnect == nil || errors.As(err, &failure) {
+			if err != nil {
+				return err
+			}
+			if received == 0 {
+				return core.Error(core.Fail(core.ReasonServerClose, io.EOF))
+			}
+			return nil
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
-			signal <- 1
-			counter.Add(1)
-			return
+		if err := u.resume(ctx, m); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
 		}
+	}
+}
 
-		scanner := bufio.NewScanner(resp.Body)
-		timeout := time.After(duration)
+// stream reads events from the current response until it ends and returns
+// how many were received. A clean end of stream is not an error.
+func (u *user) stream(ctx context.Context, m *core.Meter) (int64, error) {
+	var received atomic.Int64
+	body := &activityReader{r: u.resp.Body}
+	body.last.Store(time.Now().UnixNano())
+	errCh := make(chan error, 1)
 
-		dataReceived := false
-		lastDataTime := time.Now()
+	parser := NewParser(body)
+	parser.Resume(u.lastEventID, u.retry)
 
+	go func() {
+		var comments int64
 		for {
-			select {
-			case <-timeout:
-
-				signal <- 2
-				counter.Add(1)
-				return
-			case <-connCtx.Done():
-				if dataReceived {
-					signal <- 2
-				} else {
-					signal <- 1
+			event, err := parser.Next()
+			if parser.Comments > comments {
+				m.Count(Comments, parser.Comments-comments)
+				comments = parser.Comments
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = nil
 				}
-				counter.Add(1)
+				errCh <- err
 				return
-			default:
-
-				select {
-				case <-time.After(time.Millisecond * 500):
-					if time.Since(lastDataTime) > time.Second*5 {
-						signal <- 1
-						counter.Add(1)
-						return
-					}
-					continue
-				default:
-					if scanner.Scan() {
-
-						dataReceived = true
-						lastDataTime = time.Now()
-
-						line := scanner.Text()
-
-						if line == "" || line[:5] == "data:" || line[:6] == "event:" || line[:3] == "id:" {
-
-							continue
-						}
-					}
-
-					if err := scanner.Err(); err != nil {
-						signal <- 1
-						counter.Add(1)
-						return
-					}
-
-					if !scanner.Scan() && scanner.Err() == nil {
-						if dataReceived {
-							signal <- 2
-						} else {
-							signal <- 1
-						}
-						counter.Add(1)
-						return
-					}
-				}
 			}
+
+			m.Data(len(event.Data))
+			m.Count(u.protocol.eventCounter(event.Type), 1)
+			received.Add(1)
+			u.check(event, m)
+			if u.protocol.delivery != nil {
+				u.protocol.delivery.Observe([]byte(event.Data), m)
+			}
+			if u.ids != nil && event.HasID {
+				u.ids.observe(event.ID, m)
+			}
+		}
+	}()
+
+	idleTicker := time.NewTicker(time.Millisecond * 500)
+	defer idleTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return received.Load(), nil
+
+		case <-idleTicker.C:
+			if time.Since(time.Unix(0, body.last.Load())) > idleTimeout {
+				return received.Load(), core.Error(core.Fail(core.ReasonIdleTimeout, fmt.Errorf("no data for %v", idleTimeout)))
+			}
+
+		case err := <-errCh:
+			// The parser goroutine has finished, so its state can be carried over.
+			u.lastEventID = parser.LastEventID()
+			u.retry = parser.Retry()
+			if ctx.Err() != nil {
+				return received.Load(), nil
+			}
+			return received.Load(), err
 		}
-	} else {
-		utils.LogMessage("Timeout should be > 1 second for SSE", utils.Fatal_Error_Code)
-		signal <- 1
-		counter.Add(1)
 	}
 }
+
+func (u *user) Close() error {
+	if u.resp == nil {
+		return nil
+	}
+	return u.resp.Body.Close()
+}
+
+func (u *user) check(event Event, m *core.Meter) {
+	for _, a := range u.protocol.assertions {
+		if a.event != "" && a.event != event.Type {
+			continue
+		}
+		if a.matcher.Match([]byte(event.Data)) {
+			continue
+		}
+		m.Count(AssertionFailures, 1)
+		if a.name != "" {
+			m.Count(AssertionFailures+"."+a.name, 1)
+		}
+	}
+}
+
+// activityReader remembers when bytes last arrived so heartbeats count as activity.
+type activityReader struct {
+	r    io.Reader
+	last atomic.Int64
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
@@ -0,0 +1,98 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+)
+
+const (
+	CompressedBytesIn    = "compressed_bytes_in"
+	UncompressedBytesIn  = "uncompressed_bytes_in"
+	CompressedBytesOut   = "compressed_bytes_out"
+	UncompressedBytesOut = "uncompressed_bytes_out"
+	CompressionDeclined  = "compression_declined"
+)
+
+// compressionOffer asks for permessage-deflate without context takeover in
+// either direction, so every message is compressed on its own.
+func compressionOffer() []httphead.Option {
+	return []httphead.Option{wsflate.DefaultParameters.Option()}
+}
+
+func compressionAccepted(extensions []httphead.Option) (bool, error) {
+	for _, opt := range extensions {
+		if !bytes.Equal(opt.Name, wsflate.ExtensionNameBytes) {
+			continue
+		}
+
+		var params wsflate.Parameters
+		if err := params.Parse(opt); err != nil {
+			return false, err
+		}
+		if !params.ServerNoContextTakeover {
+			return false, fmt.Errorf("server accepted permessage-deflate without server_no_context_takeover")
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// inflate decompresses a received message and records its wire and payload size.
+func (u *user) inflate(op ws.OpCode, payload []byte, compressed bool, m *core.Meter) ([]byte, error) {
+	m.Count(CompressedBytesIn, int64(len(payload)))
+
+	if compressed {
+		var err error
+		if payload, err = wsflate.DefaultHelper.Decompress(payload); err != nil {
+			return nil, fmt.Errorf("failed to decompress message: %v", err)
+		}
+	}
+	if op == ws.OpText && !utf8.Valid(payload) {
+		return nil, fmt.Errorf("invalid utf8 in text message")
+	}
+
+	m.Count(UncompressedBytesIn, int64(len(payload)))
+	return payload, nil
+}
+
+// compress deflates a message as RFC 7692 describes: a sync flush with the
+// trailing 00 00 ff ff removed. wsflate's helper closes the stream instead,
+// which appends a final block and fails its own tail check.
+func compress(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff}), nil
+}
+
+// deflate builds a compressed client frame for a data message.
+func (u *user) deflate(op ws.OpCode, payload []byte) (ws.Frame, error) {
+	compressed, err := compress(payload)
+	if err != nil {
+		return ws.Frame{}, err
+	}
+
+	u.meter.Count(UncompressedBytesOut, int64(len(payload)))
+	u.meter.Count(CompressedBytesOut, int64(len(compressed)))
+
+	f := ws.NewFrame(op, true, compressed)
+	if f.Header, err = wsflate.SetBit(f.Header); err != nil {
+		return ws.Frame{}, err
+	}
+	return ws.MaskFrameInPlace(f), nil
+}
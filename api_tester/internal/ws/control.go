@@ -0,0 +1,132 @@
+package ws
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gobwas/ws/wsutil"
+)
+
+const (
+	PongRTT     = "pong_rtt"
+	PingsSent   = "pings_sent"
+	ServerPings = "server_pings"
+
+	closeTimeout = time.Second
+)
+
+// lockedWriter serializes control frame replies with the messages the
+// scenario and the pinger write on the same connection.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (l lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// keepalive tracks the client pings of one connection.
+type keepalive struct {
+	sent atomic.Int64
+	pong atomic.Int64
+}
+
+// readMessage returns the next text or binary message. Control frames are
+// handled on the way: pongs are timed, server pings answered and close
+// frames echoed before a wsutil.ClosedError is returned.
+func (u *user) readMessage(m *core.Meter) ([]byte, error) {
+	handle := func(h ws.Header, r io.Reader) error {
+		switch h.OpCode {
+		case ws.OpPong:
+			payload := make([]byte, h.Length)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return err
+			}
+			if len(payload) == 8 {
+				sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+				m.Observe(PongRTT, time.Since(sent))
+				u.keepalive.pong.Store(sent.UnixNano())
+			}
+			return nil
+		case ws.OpPing:
+			m.Count(ServerPings, 1)
+		}
+
+		return wsutil.ControlHandler{
+			Src:                 r,
+			Dst:                 lockedWriter{mu: &u.wmu, w: u.conn},
+			State:               ws.StateClientSide,
+			DisableSrcCiphering: true,
+		}.Handle(h)
+	}
+
+	var deflate wsflate.MessageState
+	rd := &wsutil.Reader{
+		Source:         u.rw,
+		State:          ws.StateClientSide,
+		CheckUTF8:      !u.compressed,
+		OnIntermediate: handle,
+	}
+	if u.compressed {
+		rd.State |= ws.StateExtended
+		rd.Extensions = []wsutil.RecvExtension{&deflate}
+	}
+
+	for {
+		hdr, err := rd.NextFrame()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.OpCode.IsControl() {
+			if err := handle(hdr, rd); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if hdr.OpCode&(ws.OpText|ws.OpBinary) == 0 {
+			if err := rd.Discard(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		payload, err := io.ReadAll(rd)
+		if err != nil || !u.compressed {
+			return payload, err
+		}
+		return u.inflate(hdr.OpCode, payload, deflate.IsCompressed(), m)
+	}
+}
+
+// ping sends a ping carrying the send time. It fails when the previous ping
+// is still unanswered, which is how gateways detect dead connections too.
+func (u *user) ping(m *core.Meter) error {
+	if sent := u.keepalive.sent.Load(); sent != 0 && u.keepalive.pong.Load() != sent {
+		return core.Error(core.Fail(core.ReasonIdleTimeout, fmt.Errorf("no pong within %v", u.pingInterval)))
+	}
+
+	now := time.Now().UnixNano()
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(now))
+
+	u.keepalive.sent.Store(now)
+	m.Count(PingsSent, 1)
+	return u.write(ws.OpPing, payload)
+}
+
+// closeGracefully sends a normal closure frame before the connection is torn down.
+func (u *user) closeGracefully() {
+	u.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	body := ws.NewCloseFrameBody(ws.StatusNormalClosure, "")
+	u.write(ws.OpClose, body)
+}
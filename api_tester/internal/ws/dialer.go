@@ -0,0 +1,202 @@
+package ws
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+)
+
+// JWTConfig signs a per-user HS256 token available to templates as {{.Token}}.
+// Claim values are templates; iat and, with a TTL, exp are set automatically.
+type JWTConfig struct {
+	Secret string            `yaml:"secret"`
+	Claims map[string]string `yaml:"claims"`
+	TTL    core.Duration     `yaml:"ttl"`
+}
+
+type header struct {
+	name  string
+	value *template.Template
+}
+
+type dialSettings struct {
+	headers      []header
+	cookies      []header
+	subprotocols []string
+	rows         []map[string]string
+	jwtSecret    []byte
+	jwtClaims    []header
+	jwtTTL       time.Duration
+	jwt          bool
+}
+
+func compileDial(cfg Config) (*dialSettings, error) {
+	d := &dialSettings{subprotocols: cfg.Subprotocols}
+
+	var err error
+	if d.headers, err = compileHeaders("header", cfg.Headers); err != nil {
+		return nil, err
+	}
+	if cfg.Origin != "" {
+		origin, err := compileHeaders("origin", map[string]string{"Origin": cfg.Origin})
+		if err != nil {
+			return nil, err
+		}
+		d.headers = append(d.headers, origin...)
+	}
+	if d.cookies, err = compileHeaders("cookie", cfg.Cookies); err != nil {
+		return nil, err
+	}
+
+	if cfg.Credentials != "" {
+		if d.rows, err = loadCredentials(cfg.Credentials); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.JWT != nil {
+		if cfg.JWT.Secret == "" {
+			return nil, fmt.Errorf("ws jwt secret is required")
+		}
+		if d.jwtClaims, err = compileHeaders("jwt claim", cfg.JWT.Claims); err != nil {
+			return nil, err
+		}
+		d.jwtSecret = []byte(cfg.JWT.Secret)
+		d.jwtTTL = time.Duration(cfg.JWT.TTL)
+		d.jwt = true
+	}
+	return d, nil
+}
+
+func compileHeaders(kind string, values map[string]string) ([]header, error) {
+	out := make([]header, 0, len(values))
+	for name, value := range values {
+		tmpl, err := template.New(name).Funcs(templateFuncs).Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("ws %s %s: %v", kind, name, err)
+		}
+		out = append(out, header{name: name, value: tmpl})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].name < out[j].name
+	})
+	return out, nil
+}
+
+// loadCredentials reads a CSV file whose first row names the columns.
+func loadCredentials(path string) ([]map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open credentials %s: %v", path, err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials %s: %v", path, err)
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("credentials %s needs a header row and at least one user", path)
+	}
+
+	columns := records[0]
+	rows := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(columns))
+		for i, column := range columns {
+			if i < len(record) {
+				row[strings.TrimSpace(column)] = record[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// identity resolves the CSV row and JWT of a virtual user.
+func (d *dialSettings) identity(data *templateData) error {
+	if len(d.rows) > 0 {
+		data.Row = d.rows[data.User%int64(len(d.rows))]
+	}
+	if !d.jwt {
+		return nil
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{"iat": now.Unix()}
+	if d.jwtTTL > 0 {
+		claims["exp"] = now.Add(d.jwtTTL).Unix()
+	}
+	for _, c := range d.jwtClaims {
+		value, err := render(c.value, *data)
+		if err != nil {
+			return err
+		}
+		claims[c.name] = value
+	}
+
+	token, err := signHS256(claims, d.jwtSecret)
+	if err != nil {
+		return err
+	}
+	data.Token = token
+	return nil
+}
+
+func (d *dialSettings) header(data templateData) (http.Header, error) {
+	h := http.Header{}
+	for _, hd := range d.headers {
+		value, err := render(hd.value, data)
+		if err != nil {
+			return nil, err
+		}
+		h.Set(hd.name, value)
+	}
+
+	var cookies []string
+	for _, c := range d.cookies {
+		value, err := render(c.value, data)
+		if err != nil {
+			return nil, err
+		}
+		cookies = append(cookies, (&http.Cookie{Name: c.name, Value: value}).String())
+	}
+	if len(cookies) > 0 {
+		h.Set("Cookie", strings.Join(cookies, "; "))
+	}
+	return h, nil
+}
+
+func render(tmpl *template.Template, data templateData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("template %s: %v", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
+
+func signHS256(claims map[string]interface{}, secret []byte) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	unsigned := encode([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + encode(payload)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + encode(mac.Sum(nil)), nil
+}
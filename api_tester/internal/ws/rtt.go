@@ -0,0 +1,128 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+	"github.com/belalakhter/packages/api_tester/internal/match"
+)
+
+const (
+	RTT         = "rtt"
+	RTTTimeouts = "rtt_timeouts"
+
+	defaultRTTTimeout = time.Second * 5
+)
+
+// RTTConfig correlates sent messages with server replies. In "id" mode the
+// value at the ID path of a sent JSON message is looked up in every reply; in
+// "echo" mode a reply must repeat the sent payload byte for byte.
+type RTTConfig struct {
+	Mode    string        `yaml:"mode"`
+	ID      string        `yaml:"id"`
+	Timeout core.Duration `yaml:"timeout"`
+}
+
+type rttSettings struct {
+	path    []string
+	timeout time.Duration
+}
+
+func (c *RTTConfig) compile() (*rttSettings, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	s := &rttSettings{timeout: time.Duration(c.Timeout)}
+	if s.timeout <= 0 {
+		s.timeout = defaultRTTTimeout
+	}
+
+	switch c.Mode {
+	case "echo":
+	case "id", "":
+		if c.ID == "" {
+			return nil, fmt.Errorf("rtt id path is required in id mode")
+		}
+		path, err := match.ParsePath(c.ID)
+		if err != nil {
+			return nil, fmt.Errorf("rtt: %v", err)
+		}
+		s.path = path
+	default:
+		return nil, fmt.Errorf("unknown rtt mode: %s. Supported modes: id, echo", c.Mode)
+	}
+	return s, nil
+}
+
+// tracker holds the in-flight requests of one connection.
+type tracker struct {
+	*rttSettings
+	mu      sync.Mutex
+	pending map[string]time.Time
+}
+
+func newTracker(s *rttSettings) *tracker {
+	return &tracker{rttSettings: s, pending: make(map[string]time.Time)}
+}
+
+func (t *tracker) key(msg []byte) (string, bool) {
+	if t.path == nil {
+		return string(msg), true
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(msg, &doc); err != nil {
+		return "", false
+	}
+	value, ok := match.Lookup(doc, t.path)
+	if !ok {
+		return "", false
+	}
+	return match.String(value), true
+}
+
+func (t *tracker) sent(payload []byte) {
+	key, ok := t.key(payload)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	t.pending[key] = time.Now()
+	t.mu.Unlock()
+}
+
+func (t *tracker) received(msg []byte, m *core.Meter) {
+	key, ok := t.key(msg)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	sentAt, ok := t.pending[key]
+	delete(t.pending, key)
+	t.mu.Unlock()
+
+	if ok {
+		m.Observe(RTT, time.Since(sentAt))
+	}
+}
+
+// expire counts and forgets the requests that waited longer than the timeout.
+func (t *tracker) expire(m *core.Meter) {
+	deadline := time.Now().Add(-t.timeout)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, sentAt := range t.pending {
+		if sentAt.Before(deadline) {
+			delete(t.pending, key)
+			m.Count(RTTTimeouts, 1)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package ws
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/belalakhter/packages/api_tester/internal/core"
+	"github.com/belalakhter/packages/api_tester/internal/match"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/google/uuid"
+)
+
+const (
+	ScenarioDropped = "scenario_dropped"
+
+	defaultWaitTimeout = time.Second * 10
+)
+
+// Step is one entry of a scenario; exactly one of Send, Wait, Sleep or Loop is set.
+type Step struct {
+	Send     string        `yaml:"send"`
+	Binary   bool          `yaml:"binary"`
+	Encoding string        `yaml:"encoding"`
+	Wait     *Wait         `yaml:"wait"`
+	Sleep    core.Duration `yaml:"sleep"`
+	Loop     *Loop         `yaml:"loop"`
+}
+
+type Wait struct {
+	match.Config `yaml:",inline"`
+	Timeout      core.Duration `yaml:"timeout"`
+}
+
+// Loop repeats its steps Count times, or until the session ends when Count is 0.
+type Loop struct {
+	Count int    `yaml:"count"`
+	Steps []Step `yaml:"steps"`
+}
+
+// templateData is what send payloads, headers and cookies can reference,
+// e.g. {{.User}}, {{.Row.token}} or {{uuid}}.
+type templateData struct {
+	User      int64
+	Iteration int
+	Row       map[string]string
+	Token     string
+}
+
+var templateFuncs = template.FuncMap{
+	"uuid": func() string {
+		return uuid.NewString()
+	},
+	"timestamp": func() int64 {
+		return time.Now().UnixMilli()
+	},
+	"timestamp_ns": func() int64 {
+		return time.Now().UnixNano()
+	},
+	"now": func() string {
+		return time.Now().UTC().Format(time.RFC3339Nano)
+	},
+}
+
+type step struct {
+	name    string
+	send    *template.Template
+	binary  bool
+	base64  bool
+	wait    *match.Matcher
+	timeout time.Duration
+	sleep   time.Duration
+	loop    []step
+	count   int
+	hasLoop bool
+}
+
+func compileSteps(steps []Step, prefix string) ([]step, error) {
+	out := make([]step, 0, len(steps))
+	for i, s := range steps {
+		name := fmt.Sprintf("%s%d", prefix, i+1)
+
+		set := 0
+		if s.Send != "" {
+			set++
+		}
+		if s.Wait != nil {
+			set++
+		}
+		if s.Sleep > 0 {
+			set++
+		}
+		if s.Loop != nil {
+			set++
+		}
+		if set != 1 {
+			return nil, fmt.Errorf("scenario step %s must set exactly one of send, wait, sleep or loop", name)
+		}
+
+		c := step{name: name}
+		switch {
+		case s.Send != "":
+			tmpl, err := template.New(name).Funcs(templateFuncs).Parse(s.Send)
+			if err != nil {
+				return nil, fmt.Errorf("scenario step %s: %v", name, err)
+			}
+			switch s.Encoding {
+			case "", "text":
+			case "base64":
+				c.base64 = true
+			default:
+				return nil, fmt.Errorf("scenario step %s: unknown encoding %s. Supported encodings: text, base64", name, s.Encoding)
+			}
+			c.send = tmpl
+			c.binary = s.Binary || c.base64
+		case s.Wait != nil:
+			matcher, err := s.Wait.Compile()
+			if err != nil {
+				return nil, fmt.Errorf("scenario step %s: %v", name, err)
+			}
+			c.wait = matcher
+			c.timeout = time.Duration(s.Wait.Timeout)
+			if c.timeout <= 0 {
+				c.timeout = defaultWaitTimeout
+			}
+		case s.Sleep > 0:
+			c.sleep = time.Duration(s.Sleep)
+		case s.Loop != nil:
+			if len(s.Loop.Steps) == 0 || s.Loop.Count < 0 {
+				return nil, fmt.Errorf("scenario step %s: loop needs steps and a count >= 0", name)
+			}
+			loop, err := compileSteps(s.Loop.Steps, name+".")
+			if err != nil {
+				return nil, err
+			}
+			c.loop = loop
+			c.count = s.Loop.Count
+			c.hasLoop = true
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// scenario runs the steps of one virtual user. Messages read by the
+// connection arrive on inbox; a wait consumes them until one matches.
+type scenario struct {
+	user      *user
+	inbox     <-chan []byte
+	iteration int
+}
+
+func (s *scenario) run(ctx context.Context, steps []step) error {
+	for _, st := range steps {
+		if err := s.step(ctx, st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *scenario) step(ctx context.Context, st step) error {
+	switch {
+	case st.send != nil:
+		data := s.user.data
+		data.Iteration = s.iteration
+		text, err := render(st.send, data)
+		if err != nil {
+			return core.Error(core.Fail(core.ReasonClient, fmt.Errorf("scenario step %s: %v", st.name, err)))
+		}
+
+		payload := []byte(text)
+		if st.base64 {
+			decoded, err := base64.StdEncoding.DecodeString(text)
+			if err != nil {
+				return core.Error(core.Fail(core.ReasonClient, fmt.Errorf("scenario step %s: %v", st.name, err)))
+			}
+			payload = decoded
+		}
+
+		op := ws.OpText
+		if st.binary {
+			op = ws.OpBinary
+		}
+		if s.user.tracker != nil {
+			s.user.tracker.sent(payload)
+		}
+		if err := s.user.write(op, payload); err != nil {
+			return err
+		}
+
+	case st.wait != nil:
+		timer := time.NewTimer(st.timeout)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-timer.C:
+				return core.Error(core.Fail(core.ReasonProtocol, fmt.Errorf("scenario step %s: no matching message within %v", st.name, st.timeout)))
+			case msg := <-s.inbox:
+				if st.wait.Match(msg) {
+					return nil
+				}
+			}
+		}
+
+	case st.sleep > 0:
+		select {
+		case <-ctx.Done():
+		case <-time.After(st.sleep):
+		}
+
+	case st.hasLoop:
+		for i := 0; st.count == 0 || i < st.count; i++ {
+			if ctx.Err() != nil {
+				return nil
+			}
+			s.iteration = i
+			if err := s.run(ctx, st.loop); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (u *user) write(op ws.OpCode, payload []byte) error {
+	u.wmu.Lock()
+	defer u.wmu.Unlock()
+
+	if !u.compressed || !op.IsData() {
+		if err := wsutil.WriteClientMessage(u.conn, op, payload); err != nil {
+			return core.Error(core.ReadFailure(err))
+		}
+		return nil
+	}
+
+	f, err := u.deflate(op, payload)
+	if err != nil {
+		return core.Error(core.Fail(core.ReasonClient, err))
+	}
+	if err := ws.WriteFrame(u.conn, f); err != nil {
+		return core.Error(core.ReadFailure(err))
+	}
+	return nil
+}
@@ -2,139 +2,299 @@ package ws
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/belalakhter/packages/api_tester/internal/core"
-	"github.com/belalakhter/packages/api_tester/utils"
+	"github.com/belalakhter/packages/api_tester/internal/delivery"
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 )
 
-func RunWebsocketTest(ctx context.Context, addr string, initialCount int64, PumpCount int64, duration int64) {
-	var global atomic.Uint64
-	global.Store(0)
-	Signal := make(chan int, 10000)
+const (
+	inboxSize        = 1024
+	rttSweepInterval = time.Millisecond * 100
+)
 
-	result := core.Result{
-		InitialCount: initialCount,
-		Passed:       0,
-		Failed:       0,
-		StopCount:    utils.CalculateStopCount(initialCount, PumpCount),
-	}
+// Config is the ws block of config.yaml.
+type Config struct {
+	Scenario     []Step            `yaml:"scenario"`
+	RTT          *RTTConfig        `yaml:"rtt"`
+	PingInterval core.Duration     `yaml:"ping_interval"`
+	Headers      map[string]string `yaml:"headers"`
+	Subprotocols []string          `yaml:"subprotocols"`
+	Origin       string            `yaml:"origin"`
+	Cookies      map[string]string `yaml:"cookies"`
+	Credentials  string            `yaml:"credentials"`
+	JWT          *JWTConfig        `yaml:"jwt"`
+	Compression  bool              `yaml:"compression"`
+	Delivery     *delivery.Config  `yaml:"delivery"`
+}
 
-	go func() {
-		RunSocketTest(ctx, result, PumpCount, addr, Signal, duration, &global)
-	}()
+type Protocol struct {
+	addr         string
+	scenario     []step
+	rtt          *rttSettings
+	pingInterval time.Duration
+	dial         *dialSettings
+	compression  bool
+	delivery     *delivery.Clock
+}
 
-	for {
-		sig := <-Signal
-		switch sig {
-		case 1:
-			result.Failed++
-		case 2:
-			result.Passed++
-		}
+type user struct {
+	addr         string
+	data         templateData
+	dial         *dialSettings
+	scenario     []step
+	tracker      *tracker
+	pingInterval time.Duration
+	compression  bool
+	compressed   bool
+	delivery     *delivery.Clock
+	meter        *core.Meter
+	keepalive    keepalive
+	conn         net.Conn
+	rw           io.ReadWriter
+	wmu          sync.Mutex
+	closed       atomic.Bool
+}
 
-		if global.Load() == uint64(result.StopCount) {
-			resp, err := json.Marshal(result)
-			if err != nil {
-				utils.LogMessage(err.Error(), utils.Fatal_Error_Code)
-			}
-			utils.LogMessage(string(resp), utils.Log_Info)
-			break
-		}
+func New(addr string, cfg Config) (*Protocol, error) {
+	scenario, err := compileSteps(cfg.Scenario, "")
+	if err != nil {
+		return nil, err
 	}
-}
 
-func RunSocketTest(ctx context.Context, result core.Result, PumpCount int64, addr string, signal chan int, d int64, counter *atomic.Uint64) {
-	utils.WelComePrint(
-		fmt.Sprintf("Addr Given %v", addr),
-		fmt.Sprintf("Count Given %v", result.InitialCount),
-		fmt.Sprintf("Duration Given %v", d),
-		fmt.Sprintf("PumpCount %v", PumpCount),
-	)
+	rtt, err := cfg.RTT.compile()
+	if err != nil {
+		return nil, err
+	}
+	if rtt != nil && len(scenario) == 0 {
+		return nil, fmt.Errorf("rtt needs a scenario that sends messages")
+	}
 
-	for {
-		for i := 0; i < int(result.InitialCount); i++ {
-			go func() {
-				WsIoLoop(ctx, addr, signal, d, counter)
-			}()
-		}
+	if cfg.PingInterval < 0 {
+		return nil, fmt.Errorf("ws ping_interval must not be negative")
+	}
+
+	dial, err := compileDial(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-		utils.LogMessage(fmt.Sprintf("Users Dispatched %v", result.InitialCount), 3)
+	clock, err := cfg.Delivery.Compile()
+	if err != nil {
+		return nil, err
+	}
 
-		if PumpCount == 0 {
-			break
-		}
+	return &Protocol{
+		addr:         addr,
+		scenario:     scenario,
+		rtt:          rtt,
+		pingInterval: time.Duration(cfg.PingInterval),
+		dial:         dial,
+		compression:  cfg.Compression,
+		delivery:     clock,
+	}, nil
+}
 
-		PumpCount--
-		result.InitialCount = result.InitialCount * 2
-		time.Sleep(time.Second * 1)
+func (p *Protocol) NewUser(id int64) core.VirtualUser {
+	u := &user{
+		addr:         p.addr,
+		data:         templateData{User: id},
+		dial:         p.dial,
+		scenario:     p.scenario,
+		pingInterval: p.pingInterval,
+		compression:  p.compression,
+		delivery:     p.delivery,
+	}
+	if p.rtt != nil {
+		u.tracker = newTracker(p.rtt)
 	}
+	return u
 }
 
-func WsIoLoop(ctx context.Context, addr string, signal chan int, d int64, counter *atomic.Uint64) {
-	if d > 0 {
-		duration := time.Second * time.Duration(d)
+func (u *user) Dial(ctx context.Context, m *core.Meter) error {
+	u.meter = m
+	if err := u.dial.identity(&u.data); err != nil {
+		return core.Error(core.Fail(core.ReasonClient, err))
+	}
+	header, err := u.dial.header(u.data)
+	if err != nil {
+		return core.Error(core.Fail(core.ReasonClient, err))
+	}
+	if traceparent := m.Traceparent(); traceparent != "" {
+		header.Set("Traceparent", traceparent)
+	}
 
-		connCtx, cancel := context.WithTimeout(ctx, duration+time.Second*2) // Add buffer for connection setup
-		defer cancel()
+	dialer := ws.Dialer{
+		Protocols: u.dial.subprotocols,
+		Header:    ws.HandshakeHeaderHTTP(header),
+		NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil {
+				m.Dialed()
+			}
+			return conn, err
+		},
+	}
+	if u.tracker != nil {
+		m.Register(RTTTimeouts)
+	}
+
+	if u.compression {
+		dialer.Extensions = compressionOffer()
+		m.Register(CompressionDeclined)
+	}
+
+	conn, br, hs, err := dialer.Dial(ctx, u.addr)
+	if err != nil {
+		return core.Error(dialFailure(err))
+	}
 
-		conn, _, _, err := ws.Dial(connCtx, addr)
+	if u.compression {
+		u.compressed, err = compressionAccepted(hs.Extensions)
 		if err != nil {
-			signal <- 1
-			counter.Add(1)
-			return
+			conn.Close()
+			return core.Error(core.Fail(core.ReasonHandshake, err))
 		}
-		defer conn.Close()
+		if !u.compressed {
+			m.Count(CompressionDeclined, 1)
+		}
+	}
+
+	u.conn = conn
+	u.rw = conn
+	if br != nil {
+		u.rw = struct {
+			io.Reader
+			io.Writer
+		}{io.MultiReader(br, conn), conn}
+	}
+	return nil
+}
 
-		timeout := time.After(duration)
+// Run reads server frames until ctx is done. With a scenario the steps run
+// alongside the reader; once they finish the connection is held open.
+func (u *user) Run(ctx context.Context, m *core.Meter) error {
+	errCh := make(chan error, 1)
+	if u.delivery != nil {
+		u.delivery.Init(m)
+	}
 
+	var inbox chan []byte
+	if len(u.scenario) > 0 {
+		inbox = make(chan []byte, inboxSize)
+		m.Register(ScenarioDropped)
+	}
+
+	go func() {
 		for {
-			select {
-			case <-timeout:
-				signal <- 2
-				counter.Add(1)
-				return
-			case <-connCtx.Done():
-				signal <- 1
-				counter.Add(1)
+			msg, err := u.readMessage(m)
+			if err != nil {
+				u.closed.Store(true)
+				errCh <- err
 				return
-			default:
-				conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
-				_, _, err := wsutil.ReadServerData(conn)
-				if err != nil {
-					if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-						continue
-					}
-					signal <- 1
-					counter.Add(1)
-					return
+			}
+			m.Data(len(msg))
+
+			if u.delivery != nil {
+				u.delivery.Observe(msg, m)
+			}
+			if u.tracker != nil {
+				u.tracker.received(msg, m)
+			}
+			if inbox != nil {
+				// The reader never blocks on the scenario; a wait that falls this
+				// far behind may miss the message it is waiting for.
+				select {
+				case inbox <- msg:
+				default:
+					m.Count(ScenarioDropped, 1)
 				}
 			}
 		}
-	} else {
-		conn, _, _, err := ws.Dial(ctx, addr)
-		if err != nil {
-			signal <- 1
-			counter.Add(1)
-			return
-		}
-		defer conn.Close()
+	}()
 
-		err = wsutil.WriteClientMessage(conn, ws.OpText, []byte("Ping"))
-		if err != nil {
-			signal <- 1
-			counter.Add(1)
-			return
+	scenarioCh := make(chan error, 1)
+	if len(u.scenario) > 0 {
+		go func() {
+			s := &scenario{user: u, inbox: inbox}
+			scenarioCh <- s.run(ctx, u.scenario)
+		}()
+	}
+
+	var expire <-chan time.Time
+	if u.tracker != nil {
+		ticker := time.NewTicker(rttSweepInterval)
+		defer ticker.Stop()
+		defer u.tracker.expire(m)
+		expire = ticker.C
+	}
+
+	var ping <-chan time.Time
+	if u.pingInterval > 0 {
+		ticker := time.NewTicker(u.pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-expire:
+			u.tracker.expire(m)
+		case <-ping:
+			if err := u.ping(m); err != nil {
+				return err
+			}
+		case err := <-errCh:
+			return core.Error(readFailure(err))
+		case err := <-scenarioCh:
+			if err != nil {
+				return err
+			}
 		}
+	}
+}
 
-		time.Sleep(time.Millisecond * 100)
-		signal <- 2
-		counter.Add(1)
+func (u *user) Close() error {
+	if u.conn == nil {
+		return nil
 	}
+	if !u.closed.Load() {
+		u.closeGracefully()
+	}
+	return u.conn.Close()
+}
+
+func dialFailure(err error) core.Outcome {
+	var status ws.StatusError
+	if errors.As(err, &status) {
+		return core.FailStatus(int(status))
+	}
+
+	switch {
+	case errors.Is(err, ws.ErrHandshakeBadProtocol), errors.Is(err, ws.ErrHandshakeBadUpgrade),
+		errors.Is(err, ws.ErrHandshakeBadConnection), errors.Is(err, ws.ErrHandshakeBadSecAccept),
+		errors.Is(err, ws.ErrHandshakeBadSubProtocol), errors.Is(err, ws.ErrHandshakeBadExtensions):
+		return core.Fail(core.ReasonHandshake, err)
+	}
+
+	return core.DialFailure(err)
+}
+
+func readFailure(err error) core.Outcome {
+	var closed wsutil.ClosedError
+	if errors.As(err, &closed) {
+		return core.Closed(int(closed.Code), closed.Reason)
+	}
+
+	return core.ReadFailure(err)
 }
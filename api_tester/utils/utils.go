@@ -11,6 +11,7 @@ const (
 	Fatal_Error_Code = 1
 	Debug_Error_Code = 2
 	Log_Info         = 3
+	Log_Warning      = 4
 )
 
 func LogMessage(message string, code int) {
@@ -28,6 +29,8 @@ func LogMessage(message string, code int) {
 		fmt.Printf("\nDEBUG: %s\n", message)
 	case Log_Info:
 		fmt.Printf("\nINFO: %s\n", message)
+	case Log_Warning:
+		fmt.Printf("\nWARNING: %s\n", message)
 	default:
 		fmt.Println("Unknown error code.")
 	}
@@ -43,18 +46,3 @@ func WelComePrint(var1 string, var2 string, var3 string, var4 string) {
 	fmt.Println(" Testing!")
 	fmt.Println(border)
 }
-func CalculateStopCount(count int64, pumpCount int64) int64 {
-	var TotalCount int64
-	var countNew int64
-	TotalCount = count
-	countNew = count
-	for pumpCount > 0 {
-
-		countNew = countNew * 2
-
-		TotalCount = TotalCount + countNew
-		pumpCount--
-	}
-
-	return TotalCount
-}